@@ -1,24 +1,66 @@
 package main
 
 import (
+	"context"
 	"cse224/proj4/pkg/surfstore"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 )
 
 // Arguments
 const ARG_COUNT int = 3
 
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d host:port baseDir blockSize"
+const USAGE_STRING = "./run-client.sh [command] [flags] host:port baseDir blockSize [args]"
+const REMOTE_USAGE_STRING = "./run-client.sh ls|get|put [flags] host:port [args]"
 
 const DEBUG_NAME = "d"
 const DEBUG_USAGE = "Output log statements"
 
+const INDEX_NAME = "index"
+const INDEX_USAGE = "(default = text) Local index backend: text (index.txt) or bolt (index.db, for large directories)"
+
+const RESCAN_NAME = "full-rescan"
+const RESCAN_USAGE = "Rehash every file instead of trusting unchanged size, mtime and inode"
+
+const SYMLINKS_NAME = "symlinks"
+const SYMLINKS_USAGE = "(default = skip) Symlinks pointing outside baseDir: skip them, keep them as links, or follow them and sync the files they point to"
+
+const CASE_NAME = "case-collisions"
+const CASE_USAGE = "(default = skip) Remote files whose name differs only in case from another one, on a case-insensitive filesystem: skip them, rename them on the MetaStore with a suffix (for every client), or stop with an error"
+
+const CONCURRENCY_NAME = "concurrency"
+const CONCURRENCY_USAGE = "(default = 8) Number of files hashed or transferred, and of blocks transferred, at the same time"
+
+const CACHE_DIR_NAME = "cache-dir"
+const CACHE_DIR_USAGE = "Directory (outside of baseDir) caching downloaded blocks, no cache if empty"
+
+const CACHE_SIZE_NAME = "cache-size"
+const CACHE_SIZE_USAGE = "(default = 1024) Maximum size of the block cache in MB"
+
+const DRYRUN_NAME = "dry-run"
+const DRYRUN_USAGE = "Print what a sync would do without changing baseDir or the MetaStore"
+
+const REPORT_NAME = "report"
+const REPORT_USAGE = "Print a report of what the sync did: text, or json for scripts (other messages then go to stderr)"
+
+const REPORT_TEXT = "text"
+const REPORT_JSON = "json"
+
+const OUTPUT_NAME = "o"
+const OUTPUT_USAGE = "(get without baseDir only, default = stdout) File the content is written to"
+
+const REMOTE_NAME_NAME = "name"
+const REMOTE_NAME_USAGE = "(put without baseDir only, default = base name of the path) Name of the file on the MetaStore"
+
 const ADDR_NAME = "host:port"
 const ADDR_USAGE = "IP address and port of the MetaStore the client is syncing to"
 
@@ -29,36 +71,135 @@ const BLOCK_NAME = "blockSize"
 const BLOCK_USAGE = "Size of the blocks used to fragment files"
 
 // Exit codes
+const EX_FAILURE int = 1
 const EX_USAGE int = 64
 
+// command is a subcommand of the client. Every command takes the common
+// flags and arguments, followed by its own arguments. The commands with
+// remoteArgs can also run without a base directory, taking only host:port
+// followed by remoteArgs.
+type command struct {
+	name       string
+	args       []string
+	remoteArgs []string
+	usage      string
+	run        func(client surfstore.RPCClient, args []string) int
+	runRemote  func(client surfstore.RPCClient, args []string) int
+}
+
+// Flags of a single command
+var dryRun bool
+var reportFormat string
+var outputPath string
+var remoteName string
+
+var commands = []*command{
+	{name: "sync", usage: "(default) Sync baseDir with the MetaStore", run: runSync},
+	{name: "status", usage: "Print the local changes and what a sync would do", run: runStatus},
+	{name: "ls", remoteArgs: []string{}, usage: "List the files on the MetaStore", run: runLs, runRemote: runLs},
+	{name: "get", args: []string{"file"}, remoteArgs: []string{"file"}, usage: "Download one file into baseDir, or to -o without baseDir", run: runGet, runRemote: runRemoteGet},
+	{name: "put", args: []string{"file"}, remoteArgs: []string{"blockSize", "path"}, usage: "Upload one file of baseDir, or the file at path without baseDir", run: runPut, runRemote: runRemotePut},
+	{name: "rm", args: []string{"file"}, usage: "Delete one file on the MetaStore and in baseDir", run: runRm},
+	{name: "log", args: []string{"file"}, usage: "List the versions of a file on the MetaStore", run: runLog},
+	{name: "restore", args: []string{"file", "version"}, usage: "Make an old version of a file the newest one, and get it", run: runRestore},
+	{name: "verify", usage: "Check the files of baseDir against the index, and the files on the MetaStore against the BlockStore", run: runVerify},
+}
+
 func main() {
+	// The command defaults to sync, so that the original usage still works
+	cmd, cmdArgs := commands[0], os.Args[1:]
+	if len(cmdArgs) > 0 {
+		for _, c := range commands {
+			if c.name == cmdArgs[0] {
+				cmd, cmdArgs = c, cmdArgs[1:]
+			}
+		}
+	}
+
 	// Custom flag Usage message
-	flag.Usage = func() {
-		w := flag.CommandLine.Output()
+	flags := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	flags.Usage = func() {
+		w := flags.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "   or %s:\n", REMOTE_USAGE_STRING)
+		fmt.Fprintf(w, "Commands:\n")
+		for _, c := range commands {
+			name := c.name
+			for _, arg := range c.args {
+				name += " <" + arg + ">"
+			}
+			if c.remoteArgs != nil {
+				name += " | " + c.name
+				for _, arg := range c.remoteArgs {
+					name += " <" + arg + ">"
+				}
+			}
+			fmt.Fprintf(w, "  %s: %v\n", name, c.usage)
+		}
+		fmt.Fprintf(w, "Flags and arguments:\n")
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", INDEX_NAME, INDEX_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RESCAN_NAME, RESCAN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", SYMLINKS_NAME, SYMLINKS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CASE_NAME, CASE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CONCURRENCY_NAME, CONCURRENCY_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CACHE_DIR_NAME, CACHE_DIR_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CACHE_SIZE_NAME, CACHE_SIZE_USAGE)
+		fmt.Fprintf(w, "  -%s: (sync only) %v\n", DRYRUN_NAME, DRYRUN_USAGE)
+		fmt.Fprintf(w, "  -%s: (sync only) %v\n", REPORT_NAME, REPORT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", OUTPUT_NAME, OUTPUT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", REMOTE_NAME_NAME, REMOTE_NAME_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
 	}
 
 	// Parse command-line arguments and flags
-	debug := flag.Bool("d", false, DEBUG_USAGE)
-	flag.Parse()
+	debug := flags.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	indexType := flags.String(INDEX_NAME, surfstore.INDEX_TYPE_TEXT, INDEX_USAGE)
+	fullRescan := flags.Bool(RESCAN_NAME, false, RESCAN_USAGE)
+	symlinks := flags.String(SYMLINKS_NAME, surfstore.SYMLINK_POLICY_SKIP, SYMLINKS_USAGE)
+	casePolicy := flags.String(CASE_NAME, surfstore.CASE_POLICY_SKIP, CASE_USAGE)
+	concurrency := flags.Int(CONCURRENCY_NAME, surfstore.DEFAULT_CONCURRENCY, CONCURRENCY_USAGE)
+	cacheDir := flags.String(CACHE_DIR_NAME, "", CACHE_DIR_USAGE)
+	cacheSize := flags.Int64(CACHE_SIZE_NAME, 1024, CACHE_SIZE_USAGE)
+	switch cmd.name {
+	case "sync":
+		flags.BoolVar(&dryRun, DRYRUN_NAME, false, DRYRUN_USAGE)
+		flags.StringVar(&reportFormat, REPORT_NAME, "", REPORT_USAGE)
+	case "get":
+		flags.StringVar(&outputPath, OUTPUT_NAME, "", OUTPUT_USAGE)
+	case "put":
+		flags.StringVar(&remoteName, REMOTE_NAME_NAME, "", REMOTE_NAME_USAGE)
+	}
+	flags.Parse(cmdArgs)
 
 	// Use tail arguments to hold non-flag arguments
-	args := flag.Args()
+	args := flags.Args()
 
-	if len(args) != ARG_COUNT {
-		flag.Usage()
+	switch *symlinks {
+	case surfstore.SYMLINK_POLICY_SKIP, surfstore.SYMLINK_POLICY_KEEP, surfstore.SYMLINK_POLICY_FOLLOW:
+	default:
+		flags.Usage()
 		os.Exit(EX_USAGE)
 	}
 
-	hostPort := args[0]
-	baseDir := args[1]
-	blockSize, err := strconv.Atoi(args[2])
-	if err != nil {
-		flag.Usage()
+	switch *casePolicy {
+	case surfstore.CASE_POLICY_SKIP, surfstore.CASE_POLICY_RENAME, surfstore.CASE_POLICY_ERROR:
+	default:
+		flags.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	switch reportFormat {
+	case "", REPORT_TEXT, REPORT_JSON:
+	default:
+		flags.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	if *concurrency < 1 {
+		flags.Usage()
 		os.Exit(EX_USAGE)
 	}
 
@@ -68,6 +209,236 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	// Without a base directory
+	if cmd.remoteArgs != nil && len(args) == 1+len(cmd.remoteArgs) {
+		rpcClient := surfstore.NewSurfstoreRPCClient(args[0], "", 0)
+		rpcClient.Concurrency = *concurrency
+		os.Exit(cmd.runRemote(rpcClient, args[1:]))
+	}
+
+	if len(args) != ARG_COUNT+len(cmd.args) {
+		flags.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	hostPort := args[0]
+	baseDir := args[1]
+	blockSize, err := strconv.Atoi(args[2])
+	if err != nil {
+		flags.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	if *cacheDir != "" {
+		if inside, err := surfstore.IsInsideDir(*cacheDir, baseDir); err != nil || inside {
+			fmt.Fprintf(os.Stderr, "-%s %s must be outside of the base directory %s\n", CACHE_DIR_NAME, *cacheDir, baseDir)
+			os.Exit(EX_USAGE)
+		}
+	}
+
 	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	surfstore.ClientSync(rpcClient)
+	rpcClient.IndexType = *indexType
+	rpcClient.FullRescan = *fullRescan
+	rpcClient.SymlinkPolicy = *symlinks
+	rpcClient.CasePolicy = *casePolicy
+	rpcClient.Concurrency = *concurrency
+	rpcClient.BlockCacheDir = *cacheDir
+	rpcClient.BlockCacheSize = *cacheSize * 1024 * 1024
+	os.Exit(cmd.run(rpcClient, args[ARG_COUNT:]))
+}
+
+func runSync(client surfstore.RPCClient, args []string) int {
+	if dryRun {
+		plan, err := surfstore.PlanClientSync(client)
+		if err != nil {
+			return fail(err)
+		}
+		surfstore.PrintSyncPlan(os.Stdout, plan)
+		return 0
+	}
+	// the messages printed while syncing must not mix with the JSON report
+	var output io.Writer = os.Stdout
+	if reportFormat == REPORT_JSON {
+		output = os.Stderr
+	}
+	report, err := surfstore.Sync(context.Background(), surfstore.SyncOptions{Client: client, Output: output})
+
+	// a report is printed even if the sync stopped early
+	switch reportFormat {
+	case REPORT_TEXT:
+		surfstore.PrintSyncReport(os.Stdout, report)
+	case REPORT_JSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fail(err)
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	// the files that failed are retried by the next sync
+	failed := report.Failed()
+	for _, result := range failed {
+		fmt.Fprintf(os.Stderr, "Error: %s %s: %v\n", result.Action, result.Filename, result.Err)
+	}
+	if len(failed) > 0 {
+		return EX_FAILURE
+	}
+	return 0
+}
+
+func runStatus(client surfstore.RPCClient, args []string) int {
+	plan, err := surfstore.PlanClientSync(client)
+	if err != nil {
+		return fail(err)
+	}
+	surfstore.PrintStatus(os.Stdout, plan)
+	return 0
+}
+
+func runLs(client surfstore.RPCClient, args []string) int {
+	fileMetaDatas, err := surfstore.ListRemoteFiles(client)
+	if err != nil {
+		return fail(err)
+	}
+	for _, fileMetaData := range fileMetaDatas {
+		fmt.Printf("%s\tversion %d\t%s bytes\tsha256 %s\n", fileMetaData.Filename, fileMetaData.Version, formatSize(fileMetaData), formatContentHash(fileMetaData))
+	}
+	return 0
+}
+
+// formatSize returns the size of a file, "-" if the uploader didn't send it.
+func formatSize(fileMetaData *surfstore.FileMetaData) string {
+	if fileMetaData.Size > 0 || fileMetaData.ContentHash != "" || len(fileMetaData.BlockHashList) == 0 {
+		return strconv.FormatInt(fileMetaData.Size, 10)
+	}
+	return "-"
+}
+
+// formatContentHash returns the hash of the content of a file, "-" if the
+// uploader didn't send it.
+func formatContentHash(fileMetaData *surfstore.FileMetaData) string {
+	if fileMetaData.ContentHash == "" {
+		return "-"
+	}
+	return fileMetaData.ContentHash
+}
+
+func runGet(client surfstore.RPCClient, args []string) int {
+	if err := surfstore.GetFile(client, args[0]); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func runRemoteGet(client surfstore.RPCClient, args []string) int {
+	if outputPath == "" || outputPath == "-" {
+		if _, err := surfstore.DownloadFile(client, args[0], os.Stdout); err != nil {
+			return fail(err)
+		}
+		return 0
+	}
+	// the output file is only replaced once the download is complete
+	af, err := surfstore.CreateAtomicFile(outputPath)
+	if err != nil {
+		return fail(err)
+	}
+	fileMetaData, err := surfstore.DownloadFile(client, args[0], af)
+	if err != nil {
+		af.Abort()
+		return fail(err)
+	}
+	if fileMetaData.ModTime != 0 {
+		os.Chtimes(af.Name(), time.Now(), time.Unix(0, fileMetaData.ModTime))
+	}
+	if err := af.Commit(surfstore.FileModeOf(fileMetaData)); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func runPut(client surfstore.RPCClient, args []string) int {
+	if err := surfstore.PutFile(client, args[0]); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func runRemotePut(client surfstore.RPCClient, args []string) int {
+	blockSize, err := strconv.Atoi(args[0])
+	if err != nil || blockSize < 1 {
+		return fail(fmt.Errorf("invalid block size %q", args[0]))
+	}
+	client.BlockSize = blockSize
+	name := remoteName
+	if name == "" {
+		name = filepath.Base(args[1])
+	}
+	f, err := os.Open(args[1])
+	if err != nil {
+		return fail(err)
+	}
+	defer f.Close()
+	fileMetaData, err := surfstore.UploadFile(client, name, f)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Printf("%s\tversion %d\n", fileMetaData.Filename, fileMetaData.Version)
+	return 0
+}
+
+func runRm(client surfstore.RPCClient, args []string) int {
+	if err := surfstore.RemoveFile(client, args[0]); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func runLog(client surfstore.RPCClient, args []string) int {
+	history, err := surfstore.ListFileVersions(client, args[0])
+	if err != nil {
+		return fail(err)
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if surfstore.IsDeleted(history[i]) {
+			fmt.Printf("version %d\tdeleted\n", history[i].Version)
+		} else if history[i].RenamedFrom != "" {
+			fmt.Printf("version %d\trenamed from %s\t%s bytes\tsha256 %s\n", history[i].Version, history[i].RenamedFrom, formatSize(history[i]), formatContentHash(history[i]))
+		} else {
+			fmt.Printf("version %d\t%d blocks\t%s bytes\tsha256 %s\n", history[i].Version, len(history[i].BlockHashList), formatSize(history[i]), formatContentHash(history[i]))
+		}
+	}
+	return 0
+}
+
+func runRestore(client surfstore.RPCClient, args []string) int {
+	version, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fail(fmt.Errorf("invalid version %q", args[1]))
+	}
+	if err := surfstore.RestoreFile(client, args[0], int32(version)); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func runVerify(client surfstore.RPCClient, args []string) int {
+	problems, err := surfstore.VerifyFiles(client)
+	if err != nil {
+		return fail(err)
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return EX_FAILURE
+	}
+	fmt.Println("No problem found")
+	return 0
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	return EX_FAILURE
 }
@@ -20,6 +20,9 @@ const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockSt
 // Set of valid services
 var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
 
+// Set of valid filename normalizations
+var NORMALIZATIONS = map[string]bool{surfstore.NORMALIZATION_NONE: true, surfstore.NORMALIZATION_REJECT: true, surfstore.NORMALIZATION_NFC: true}
+
 // Exit codes
 const EX_USAGE int = 64
 
@@ -39,6 +42,8 @@ func main() {
 	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
 	localOnly := flag.Bool("l", false, "Only listen on localhost")
 	debug := flag.Bool("d", false, "Output log statements")
+	rejectCaseDuplicates := flag.Bool("reject-case-duplicates", false, "Reject new files whose name differs only in case from an existing one")
+	normalization := flag.String("filenames", surfstore.NORMALIZATION_NONE, "(default = none) New filenames that aren't normalized (NFC): keep them (none), reject them (reject), or normalize them (nfc)")
 	flag.Parse()
 
 	// Use tail arguments to hold BlockStore address
@@ -53,6 +58,10 @@ func main() {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
+	if _, ok := NORMALIZATIONS[*normalization]; !ok {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
 
 	// Add localhost if necessary
 	addr := ""
@@ -67,15 +76,17 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr))
+	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr, *rejectCaseDuplicates, *normalization))
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddr string) error {
+func startServer(hostAddr string, serviceType string, blockStoreAddr string, rejectCaseDuplicates bool, normalization string) error {
 	// Create a new RPC server
 	grpcServer := grpc.NewServer()
 	// Register RPC services
 	if serviceType == "meta" || serviceType == "both" {
 		metaStore := surfstore.NewMetaStore(blockStoreAddr)
+		metaStore.RejectCaseDuplicates = rejectCaseDuplicates
+		metaStore.FilenameNormalization = normalization
 		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
 	}
 	if serviceType == "block" || serviceType == "both" {
@@ -18,7 +18,7 @@ func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Bloc
 	defer bs.mutex.Unlock()
 	block, ok := bs.BlockMap[blockHash.Hash]
 	if !ok {
-		return nil, badStringError("Bad entry in bs.BlockMap!", "")
+		return nil, blockNotFoundError(blockHash.Hash)
 	}
 	return block, nil
 }
@@ -0,0 +1,163 @@
+package surfstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Case Collision Related
+*/
+
+// CaseCollision is a remote file that can't be downloaded on a
+// case-insensitive filesystem, because its name differs only in case from
+// another file of the base directory (or downloaded by the same sync).
+type CaseCollision struct {
+	File         *FileMetaData
+	CollidesWith string
+}
+
+// CaseFoldKey returns the name files collide on in a case-insensitive
+// filesystem.
+func CaseFoldKey(filename string) string {
+	return strings.ToLower(filename)
+}
+
+// IsCaseInsensitiveDir reports whether names differing only in case are the
+// same file in dir. It looks up an existing name with its case flipped, so
+// nothing is written to dir.
+func IsCaseInsensitiveDir(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	candidates := []string{abs}
+	if files, err := os.ReadDir(abs); err == nil {
+		for _, file := range files {
+			candidates = append(candidates, filepath.Join(abs, file.Name()))
+		}
+	}
+	for _, candidate := range candidates {
+		flipped := filepath.Join(filepath.Dir(candidate), flipCase(filepath.Base(candidate)))
+		if flipped == candidate {
+			continue
+		}
+		info, err := os.Lstat(candidate)
+		if err != nil {
+			continue
+		}
+		flipped_info, err := os.Lstat(flipped)
+		return err == nil && os.SameFile(info, flipped_info)
+	}
+	// no name with letters to check
+	return false
+}
+
+// isCaseInsensitiveDir is IsCaseInsensitiveDir, as used by the sync, tests
+// running on a case-sensitive filesystem replace it.
+var isCaseInsensitiveDir = IsCaseInsensitiveDir
+
+func flipCase(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, name)
+}
+
+// planCaseCollisions moves the downloads that would overwrite another file
+// of a case-insensitive base directory to plan.CaseCollisions. Remote
+// deletions of files that don't exist locally under their exact name only
+// update the index, as deleting them would delete the other file.
+func planCaseCollisions(plan *SyncPlan, local_FileInfoMap map[string]*FileMetaData) {
+	local_exists := func(filename string) bool {
+		local_meta_data, ok := local_FileInfoMap[filename]
+		return ok && !IsDeleted(local_meta_data)
+	}
+	downloads := make([]*FileMetaData, 0, len(plan.Downloads))
+	deleted := make(map[string]bool)
+	for _, remote_meta_data := range plan.Downloads {
+		if IsDeleted(remote_meta_data) && !local_exists(remote_meta_data.Filename) {
+			plan.Unchanged = append(plan.Unchanged, remote_meta_data)
+			continue
+		} else if IsDeleted(remote_meta_data) {
+			deleted[remote_meta_data.Filename] = true
+		}
+		downloads = append(downloads, remote_meta_data)
+	}
+	sortMetaList(plan.Unchanged)
+	plan.Downloads = downloads
+
+	// the names taken once the sync is done, deletions are applied before downloads
+	occupied := make(map[string]string)
+	for filename := range local_FileInfoMap {
+		if local_exists(filename) && !deleted[filename] {
+			occupied[CaseFoldKey(filename)] = filename
+		}
+	}
+	for _, fileRename := range plan.RemoteRenames {
+		delete(occupied, CaseFoldKey(fileRename.From.Filename))
+		occupied[CaseFoldKey(fileRename.To.Filename)] = fileRename.To.Filename
+	}
+
+	downloads = make([]*FileMetaData, 0, len(plan.Downloads))
+	for _, remote_meta_data := range plan.Downloads {
+		key := CaseFoldKey(remote_meta_data.Filename)
+		if other, ok := occupied[key]; ok && other != remote_meta_data.Filename && !IsDeleted(remote_meta_data) {
+			plan.CaseCollisions = append(plan.CaseCollisions, &CaseCollision{File: remote_meta_data, CollidesWith: other})
+			continue
+		} else if !IsDeleted(remote_meta_data) {
+			occupied[key] = remote_meta_data.Filename
+		}
+		downloads = append(downloads, remote_meta_data)
+	}
+	plan.Downloads = downloads
+}
+
+// suffixedFilename returns filename with suffix before its extension, and a
+// number after suffix if needed, so that no file of the given maps has the
+// same name, ignoring case, and no file of baseDir has that name either,
+// such as a file left out of the sync.
+func suffixedFilename(baseDir string, filename string, suffix string, FileInfoMaps ...map[string]*FileMetaData) string {
+	taken := make(map[string]bool)
+	for _, FileInfoMap := range FileInfoMaps {
+		for filename := range FileInfoMap {
+			taken[CaseFoldKey(filename)] = true
+		}
+	}
+	on_disk := func(name string) bool {
+		_, err := os.Lstat(filepath.Join(baseDir, name))
+		return !os.IsNotExist(err)
+	}
+	ext := filepath.Ext(filename)
+	new_filename := strings.TrimSuffix(filename, ext) + suffix + ext
+	for i := 2; taken[CaseFoldKey(new_filename)] || on_disk(new_filename); i++ {
+		new_filename = fmt.Sprintf("%s%s %d%s", strings.TrimSuffix(filename, ext), suffix, i, ext)
+	}
+	return new_filename
+}
+
+// RenameCaseCollision renames a colliding file on the server to a name
+// with CASE_CONFLICT_SUFFIX that is free on the server and in the base
+// directory, and returns the deletion of the old name and the new file.
+func RenameCaseCollision(client RPCClient, collision *CaseCollision, local_FileInfoMap map[string]*FileMetaData, remote_FileInfoMap map[string]*FileMetaData) (*FileRename, error) {
+	filename := collision.File.Filename
+	new_filename := suffixedFilename(client.BaseDir, filename, CASE_CONFLICT_SUFFIX, local_FileInfoMap, remote_FileInfoMap)
+
+	to := proto.Clone(collision.File).(*FileMetaData)
+	to.Filename = new_filename
+	to.Version = 1
+	to.RenamedFrom = ""
+	fileRename := &FileRename{From: NewTombstone(filename, collision.File.Version+1), To: to}
+	var latestVersion int32
+	if err := client.RenameFile(fileRename.From, fileRename.To, &latestVersion); err != nil {
+		return nil, fmt.Errorf("rename %s to %s: %w", filename, new_filename, err)
+	}
+	return fileRename, nil
+}
@@ -0,0 +1,102 @@
+package surfstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// caseInsensitive makes the sync treat base directories as case-insensitive
+// until the end of the test.
+func caseInsensitive(t *testing.T) {
+	isCaseInsensitiveDir = func(dir string) bool { return true }
+	t.Cleanup(func() { isCaseInsensitiveDir = IsCaseInsensitiveDir })
+}
+
+func TestSyncCasePolicies(t *testing.T) {
+	renamed := "A (case conflict).txt"
+	tests := []struct {
+		policy string
+		failed bool
+		action string            // reported for A.txt, or its new name
+		files  map[string]string // in the base directory once synced
+		remote map[string]int32  // versions on the server, 0 if deleted
+	}{
+		{CASE_POLICY_SKIP, false, SYNC_ACTION_SKIP, map[string]string{"a.txt": "lower"}, map[string]int32{"a.txt": 1, "A.txt": 1}},
+		{CASE_POLICY_RENAME, false, SYNC_ACTION_RENAME_REMOTE, map[string]string{"a.txt": "lower", renamed: "upper"}, map[string]int32{"a.txt": 1, "A.txt": 0, renamed: 1}},
+		{CASE_POLICY_ERROR, true, "", map[string]string{"a.txt": "lower"}, map[string]int32{"a.txt": 1, "A.txt": 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			addr := startTestServer(t)
+			client, other := newTestClient(t, addr), newTestClient(t, addr)
+			client.CasePolicy = test.policy
+			writeTestFiles(t, client, map[string]string{"a.txt": "lower"})
+			testSync(t, client)
+			writeTestFiles(t, other, map[string]string{"A.txt": "upper"})
+			testSync(t, other)
+
+			caseInsensitive(t)
+			var output bytes.Buffer
+			report, err := Sync(context.Background(), SyncOptions{Client: client, Output: &output})
+			if (err != nil) != test.failed {
+				t.Fatalf("Sync() = %v, want failed: %v", err, test.failed)
+			}
+			if test.failed {
+				if !strings.Contains(output.String(), "A.txt differs only in case from a.txt") {
+					t.Errorf("output %q doesn't name the collision", output.String())
+				}
+				if len(report.Files) != 0 {
+					t.Errorf("files synced before the error: %v", report.Files)
+				}
+			} else if len(report.Files) == 0 || report.Files[0].Action != test.action || report.Files[0].Err != nil {
+				t.Errorf("synced %v, want A.txt first with %s", report.Files, test.action)
+			}
+
+			files, err := os.ReadDir(client.BaseDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			for _, file := range files {
+				if file.Name() == DEFAULT_META_FILENAME || file.Name() == DEFAULT_JOURNAL_FILENAME {
+					continue
+				}
+				content, err := os.ReadFile(filepath.Join(client.BaseDir, file.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[file.Name()] = string(content)
+			}
+			if !reflect.DeepEqual(got, test.files) {
+				t.Errorf("files %v, want %v", got, test.files)
+			}
+
+			var remote_FileInfoMap map[string]*FileMetaData
+			if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+				t.Fatal(err)
+			}
+			for filename, version := range test.remote {
+				remote_meta_data, ok := remote_FileInfoMap[filename]
+				if !ok || (version == 0) != IsDeleted(remote_meta_data) || (version != 0 && remote_meta_data.Version != version) {
+					t.Errorf("%s on the server: %v, want version %d", filename, remote_meta_data, version)
+				}
+			}
+
+			// the next sync has nothing new to do
+			report, err = Sync(context.Background(), SyncOptions{Client: client})
+			if (err != nil) != test.failed {
+				t.Fatalf("second Sync() = %v, want failed: %v", err, test.failed)
+			}
+			for _, result := range report.Files {
+				if result.Action != SYNC_ACTION_SKIP {
+					t.Errorf("second sync: %s of %s", result.Action, result.Filename)
+				}
+			}
+		})
+	}
+}
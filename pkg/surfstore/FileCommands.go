@@ -0,0 +1,476 @@
+package surfstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Single File Commands
+*/
+
+// ListRemoteFiles returns the files on the server, sorted by filename.
+// Deleted files are left out.
+func ListRemoteFiles(client RPCClient) ([]*FileMetaData, error) {
+	var remote_FileInfoMap map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+		return nil, fmt.Errorf("get file info map: %w", err)
+	}
+	fileMetaDatas := make([]*FileMetaData, 0, len(remote_FileInfoMap))
+	for _, remote_meta_data := range remote_FileInfoMap {
+		if !IsDeleted(remote_meta_data) {
+			fileMetaDatas = append(fileMetaDatas, remote_meta_data)
+		}
+	}
+	sortMetaList(fileMetaDatas)
+	return fileMetaDatas, nil
+}
+
+// GetFile syncs a single file from the server into the base directory. It
+// fails if the local copy has changes that were never synced.
+func GetFile(client RPCClient, filename string) error {
+	filename = NormalizeFilename(filename)
+	local_index, committed_FileInfoMap, committed_FileStats, err := openCommittedIndex(client)
+	if err != nil {
+		return err
+	}
+	defer local_index.Close()
+
+	var remote_FileInfoMap map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+		return fmt.Errorf("get file info map: %w", err)
+	}
+	remote_meta_data, ok := remote_FileInfoMap[filename]
+	if !ok {
+		return &FileNotFoundError{Filename: filename}
+	}
+
+	local_meta_data, _, err := localFileMeta(client, committed_FileInfoMap, committed_FileStats, filename)
+	if err != nil {
+		return err
+	}
+	in_sync := local_meta_data != nil && CompareHashlist(local_meta_data.BlockHashList, remote_meta_data.BlockHashList)
+	if !in_sync && hasLocalChanges(local_meta_data, committed_FileInfoMap) {
+		return fmt.Errorf("%s has local changes, put or sync it first", filename)
+	}
+	if !in_sync {
+		transfers := NewTransfers(client, indexHashlists(committed_FileInfoMap), nil)
+		if err := Download_helper(client, transfers, remote_meta_data); err != nil {
+			return err
+		}
+	}
+	return commitFile(client, local_index, remote_meta_data)
+}
+
+// PutFile syncs a single file of the base directory to the server. A file
+// missing from the base directory is deleted on the server. It fails if the
+// file was changed on the server since it was last synced.
+func PutFile(client RPCClient, filename string) error {
+	filename = NormalizeFilename(filename)
+	local_index, committed_FileInfoMap, committed_FileStats, err := openCommittedIndex(client)
+	if err != nil {
+		return err
+	}
+	defer local_index.Close()
+
+	local_meta_data, local_stat, err := localFileMeta(client, committed_FileInfoMap, committed_FileStats, filename)
+	if err != nil {
+		return err
+	}
+	if local_meta_data == nil {
+		return fmt.Errorf("%s doesn't exist", filename)
+	}
+
+	var remote_FileInfoMap map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+		return fmt.Errorf("get file info map: %w", err)
+	}
+	expected_version := NO_FILE_VERSION
+	if remote_meta_data, ok := remote_FileInfoMap[filename]; ok {
+		if CompareHashlist(local_meta_data.BlockHashList, remote_meta_data.BlockHashList) {
+			// already on the server
+			return commitFile(client, local_index, remote_meta_data)
+		}
+		if local_meta_data.Version != remote_meta_data.Version+1 {
+			return fmt.Errorf("%s was changed on the server (version %d), get or sync it first", filename, remote_meta_data.Version)
+		}
+		expected_version = remote_meta_data.Version
+	}
+
+	transfers := NewTransfers(client, nil, nil)
+	if err := Upload_helper(client, transfers, local_meta_data, local_stat, IsDeleted(local_meta_data), expected_version); err != nil {
+		return err
+	}
+	return commitFile(client, local_index, local_meta_data)
+}
+
+// RemoveFile deletes a file on the server, then in the base directory. It
+// fails if the local copy has changes that were never synced.
+func RemoveFile(client RPCClient, filename string) error {
+	filename = NormalizeFilename(filename)
+	local_index, committed_FileInfoMap, committed_FileStats, err := openCommittedIndex(client)
+	if err != nil {
+		return err
+	}
+	defer local_index.Close()
+
+	var remote_FileInfoMap map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+		return fmt.Errorf("get file info map: %w", err)
+	}
+	remote_meta_data, ok := remote_FileInfoMap[filename]
+	if !ok || IsDeleted(remote_meta_data) {
+		return &FileNotFoundError{Filename: filename}
+	}
+
+	local_meta_data, _, err := localFileMeta(client, committed_FileInfoMap, committed_FileStats, filename)
+	if err != nil {
+		return err
+	}
+	in_sync := local_meta_data != nil && CompareHashlist(local_meta_data.BlockHashList, remote_meta_data.BlockHashList)
+	if !in_sync && hasLocalChanges(local_meta_data, committed_FileInfoMap) {
+		return fmt.Errorf("%s has local changes, put or sync it first", filename)
+	}
+
+	tombstone := NewTombstone(filename, remote_meta_data.Version+1)
+	if err := Upload_helper(client, NewTransfers(client, nil, nil), tombstone, nil, true, remote_meta_data.Version); err != nil {
+		return err
+	}
+	if err := os.Remove(ConcatPath(client.BaseDir, filename)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("delete %s: %w", filename, err)
+	}
+	return commitFile(client, local_index, tombstone)
+}
+
+// ListFileVersions returns every version of a file stored on the server, oldest first.
+func ListFileVersions(client RPCClient, filename string) ([]*FileMetaData, error) {
+	var history []*FileMetaData
+	if err := client.GetFileHistory(filename, &history); errors.Is(err, ErrNotFound) && NormalizeFilename(filename) != filename {
+		// the file may only be known by its normalized name
+		return ListFileVersions(client, NormalizeFilename(filename))
+	} else if err != nil {
+		return nil, fmt.Errorf("get history of %s: %w", filename, err)
+	}
+	return history, nil
+}
+
+// RestoreFile makes the content of an old version of a file its newest
+// version on the server, then gets it into the base directory.
+func RestoreFile(client RPCClient, filename string, version int32) error {
+	history, err := ListFileVersions(client, filename)
+	if err != nil {
+		return err
+	}
+	// the history may have been found under the normalized name, which is the one to update
+	filename = history[len(history)-1].Filename
+	var restored_meta_data *FileMetaData
+	for _, fileMetaData := range history {
+		if fileMetaData.Version == version {
+			restored_meta_data = fileMetaData
+		}
+	}
+	if restored_meta_data == nil {
+		return fmt.Errorf("%s has no version %d", filename, version)
+	}
+
+	// the local copy is replaced, so it must not have changes that were never synced
+	committed_FileInfoMap, committed_FileStats, err := LoadLocalIndexReadOnly(client)
+	if err != nil {
+		return err
+	}
+	local_meta_data, _, err := localFileMeta(client, committed_FileInfoMap, committed_FileStats, filename)
+	if err != nil {
+		return err
+	}
+	if hasLocalChanges(local_meta_data, committed_FileInfoMap) {
+		return fmt.Errorf("%s has local changes, put or sync it first", filename)
+	}
+
+	// the blocks of old versions are never removed from the BlockStore
+	// the restored version keeps the attributes the old one had
+	latest_meta_data := history[len(history)-1]
+	new_meta_data := proto.Clone(restored_meta_data).(*FileMetaData)
+	new_meta_data.Filename = filename
+	new_meta_data.Version = latest_meta_data.Version + 1
+	new_meta_data.RenamedFrom = ""
+	var latestVersion int32
+	err = client.UpdateFileIf(new_meta_data, latest_meta_data.Version, &latestVersion)
+	if err != nil {
+		return fmt.Errorf("update %s: %w", filename, err)
+	}
+	return GetFile(client, filename)
+}
+
+// VerifyFiles checks that the local files the index sees as unchanged still
+// have the content recorded in the index, and that every block of the files
+// on the server is in the BlockStore. It returns the problems found.
+func VerifyFiles(client RPCClient) ([]string, error) {
+	committed_FileInfoMap, committed_FileStats, err := LoadLocalIndexReadOnly(client)
+	if err != nil {
+		return nil, err
+	}
+	problems := make([]string, 0)
+
+	committed_FileMetaDatas := metaMapValues(committed_FileInfoMap)
+	sortMetaList(committed_FileMetaDatas)
+	for _, committed_meta_data := range committed_FileMetaDatas {
+		filename := committed_meta_data.Filename
+		info, err := os.Lstat(ConcatPath(client.BaseDir, filename))
+		if IsDeleted(committed_meta_data) || isSymlink(committed_meta_data) || err != nil || !NewFileStat(info).Unchanged(committed_FileStats[filename]) {
+			// deleted or modified since the last sync, the next sync uploads it
+			continue
+		}
+		hashlist, content_hash, err := HashFile(ConcatPath(client.BaseDir, filename), client.BlockSize)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", filename, err))
+		} else if !CompareHashlist(hashlist, committed_meta_data.BlockHashList) || (committed_meta_data.ContentHash != "" && content_hash != committed_meta_data.ContentHash) {
+			problems = append(problems, fmt.Sprintf("%s: local content doesn't match the index although its size, mtime and inode are unchanged", filename))
+		}
+	}
+
+	remote_FileMetaDatas, err := ListRemoteFiles(client)
+	if err != nil {
+		return nil, err
+	}
+	var BlockStoreAddr string
+	if err := client.GetBlockStoreAddr(&BlockStoreAddr); err != nil {
+		return nil, fmt.Errorf("get block store address: %w", err)
+	}
+	for _, remote_meta_data := range remote_FileMetaDatas {
+		missing_hash_set, err := MissingBlocks(client, BlockStoreAddr, remote_meta_data.BlockHashList)
+		if err != nil {
+			return nil, fmt.Errorf("check blocks of %s: %w", remote_meta_data.Filename, err)
+		}
+		if len(missing_hash_set) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: %d blocks of version %d are missing from the BlockStore", remote_meta_data.Filename, len(missing_hash_set), remote_meta_data.Version))
+		}
+	}
+	return problems, nil
+}
+
+/*
+	Commands Without a Base Directory
+*/
+
+// DownloadFile writes the content of a file on the server to w. It needs no
+// base directory, and the blocks are fetched a window at a time. The content
+// is checked against the size and hash of the file once it is all written.
+func DownloadFile(client RPCClient, filename string, w io.Writer) (*FileMetaData, error) {
+	var remote_FileInfoMap map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+		return nil, fmt.Errorf("get file info map: %w", err)
+	}
+	remote_meta_data, ok := remote_FileInfoMap[filename]
+	if !ok {
+		remote_meta_data, ok = remote_FileInfoMap[NormalizeFilename(filename)]
+	}
+	if !ok || IsDeleted(remote_meta_data) {
+		return nil, &FileNotFoundError{Filename: filename}
+	}
+	var BlockStoreAddr string
+	if err := client.GetBlockStoreAddr(&BlockStoreAddr); err != nil {
+		return nil, fmt.Errorf("get block store address: %w", err)
+	}
+
+	block_pool := NewWorkerPool(client.Concurrency)
+	content_digest := sha256.New()
+	w = io.MultiWriter(w, content_digest)
+	var size int64
+	remote_hash_list := remote_meta_data.BlockHashList
+	// the only file transferred, it has the whole budget
+	window := TransferBudget(client)
+	for start := 0; start < len(remote_hash_list); start += window {
+		end := start + window
+		if end > len(remote_hash_list) {
+			end = len(remote_hash_list)
+		}
+		fetch_hash_list := DistinctHashes(remote_hash_list[start:end])
+		blocks := make([]*Block, len(fetch_hash_list))
+		err := block_pool.Run(len(fetch_hash_list), func(i int) error {
+			blocks[i] = &Block{}
+			if err := client.GetBlock(fetch_hash_list[i], BlockStoreAddr, blocks[i]); err != nil {
+				return fmt.Errorf("get block %s of %s: %w", fetch_hash_list[i], filename, err)
+			}
+			if GetBlockHashString(blocks[i].BlockData) != fetch_hash_list[i] {
+				return fmt.Errorf("get block %s of %s: content doesn't match its hash", fetch_hash_list[i], filename)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		fetched_blocks := make(map[string]*Block)
+		for i, hash := range fetch_hash_list {
+			fetched_blocks[hash] = blocks[i]
+		}
+		for _, hash := range remote_hash_list[start:end] {
+			if _, err := w.Write(fetched_blocks[hash].BlockData); err != nil {
+				return nil, fmt.Errorf("write %s: %w", filename, err)
+			}
+			size += int64(len(fetched_blocks[hash].BlockData))
+		}
+	}
+	if err := VerifyContent(remote_meta_data, size, hex.EncodeToString(content_digest.Sum(nil))); err != nil {
+		return nil, err
+	}
+	return remote_meta_data, nil
+}
+
+// UploadFile uploads the content of r as the newest version of a file on the
+// server, whatever its current version is. It fails with a
+// VersionConflictError if the file is changed by another client during the
+// upload. It needs no base directory. r is read twice, once to hash it and
+// once to upload the missing blocks.
+func UploadFile(client RPCClient, filename string, r io.ReadSeeker) (*FileMetaData, error) {
+	filename = NormalizeFilename(filename)
+	hash_list, size, content_hash, err := HashReader(r, client.BlockSize)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", filename, err)
+	}
+
+	var remote_FileInfoMap map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+		return nil, fmt.Errorf("get file info map: %w", err)
+	}
+	local_meta_data := &FileMetaData{Filename: filename, Version: 1, BlockHashList: hash_list, Size: size, ContentHash: content_hash}
+	expected_version := NO_FILE_VERSION
+	if remote_meta_data, ok := remote_FileInfoMap[filename]; ok {
+		if CompareHashlist(remote_meta_data.BlockHashList, hash_list) {
+			// already on the server
+			return remote_meta_data, nil
+		}
+		local_meta_data.Version = remote_meta_data.Version + 1
+		expected_version = remote_meta_data.Version
+	}
+
+	var BlockStoreAddr string
+	if err := client.GetBlockStoreAddr(&BlockStoreAddr); err != nil {
+		return nil, fmt.Errorf("get block store address: %w", err)
+	}
+	missing_hash_set, err := MissingBlocks(client, BlockStoreAddr, hash_list)
+	if err != nil {
+		return nil, fmt.Errorf("check blocks of %s: %w", filename, err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("read %s: %w", filename, err)
+	}
+	transfers := &Transfers{BlockPool: NewWorkerPool(client.Concurrency)}
+	if err := PutBlocks(client, transfers, BlockStoreAddr, r, local_meta_data, 0, missing_hash_set); err != nil {
+		return nil, err
+	}
+
+	var latestVersion int32
+	if err := client.UpdateFileIf(local_meta_data, expected_version, &latestVersion); err != nil {
+		return nil, fmt.Errorf("update %s: %w", filename, err)
+	}
+	return local_meta_data, nil
+}
+
+// openCommittedIndex opens and loads the local index.
+func openCommittedIndex(client RPCClient) (LocalIndex, map[string]*FileMetaData, map[string]*FileStat, error) {
+	local_index, err := OpenLocalIndex(client)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("open local index: %w", err)
+	}
+	committed_FileInfoMap, committed_FileStats, err := local_index.Load()
+	if err != nil {
+		local_index.Close()
+		return nil, nil, nil, fmt.Errorf("load local index: %w", err)
+	}
+	return local_index, committed_FileInfoMap, committed_FileStats, nil
+}
+
+// localFileMeta returns the FileMetaData GitAdd gives to one file of the base
+// directory, and its stat data. It returns nil if the file neither exists nor
+// is in the index.
+func localFileMeta(client RPCClient, committed_FileInfoMap map[string]*FileMetaData, committed_FileStats map[string]*FileStat, filename string) (*FileMetaData, *FileStat, error) {
+	committed_meta_data, in_index := committed_FileInfoMap[filename]
+	info, err := os.Lstat(ConcatPath(client.BaseDir, filename))
+	if os.IsNotExist(err) {
+		if !in_index || IsDeleted(committed_meta_data) {
+			return committed_meta_data, nil, nil
+		}
+		return NewTombstone(filename, committed_meta_data.Version+1), nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	local_stat := NewFileStat(info)
+	local_hashlist := []string(nil)
+	if info.Mode()&os.ModeSymlink != 0 {
+		if local_stat, err = NewLinkStat(ConcatPath(client.BaseDir, filename), info); err != nil {
+			return nil, nil, err
+		}
+		if IsSymlinkOutside(local_stat.LinkTarget) && client.SymlinkPolicy == SYMLINK_POLICY_FOLLOW {
+			// the file it points to
+			if info, err = os.Stat(ConcatPath(client.BaseDir, filename)); err != nil {
+				return nil, nil, err
+			}
+			local_stat = NewFileStat(info)
+		} else if IsSymlinkOutside(local_stat.LinkTarget) && client.SymlinkPolicy != SYMLINK_POLICY_KEEP {
+			return nil, nil, fmt.Errorf("%s is a symlink pointing outside the base directory", filename)
+		} else {
+			local_hashlist = LinkHashlist(local_stat.LinkTarget, client.BlockSize)
+		}
+	}
+	if local_hashlist == nil && !info.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s isn't a regular file", filename)
+	} else if local_hashlist == nil && in_index && !client.FullRescan && local_stat.Unchanged(committed_FileStats[filename]) {
+		local_hashlist = committed_meta_data.BlockHashList
+		local_stat.ContentHash = committed_meta_data.ContentHash
+	} else if local_hashlist == nil {
+		if local_hashlist, local_stat.ContentHash, err = HashFile(ConcatPath(client.BaseDir, filename), client.BlockSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	local_Filehashlists := map[string][]string{filename: local_hashlist}
+	local_FileStats := map[string]*FileStat{filename: local_stat}
+	index_FileInfoMap := make(map[string]*FileMetaData)
+	if in_index {
+		index_FileInfoMap[filename] = committed_meta_data
+	}
+	local_FileInfoMap, err := GitAdd(client, local_Filehashlists, local_FileStats, index_FileInfoMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	return local_FileInfoMap[filename], local_stat, nil
+}
+
+// hasLocalChanges reports whether a local file has content that was never
+// synced and would be lost if it was overwritten. A deleted file has none.
+func hasLocalChanges(local_meta_data *FileMetaData, committed_FileInfoMap map[string]*FileMetaData) bool {
+	if local_meta_data == nil || IsDeleted(local_meta_data) {
+		return false
+	}
+	committed_meta_data, ok := committed_FileInfoMap[local_meta_data.Filename]
+	return !ok || committed_meta_data.Version != local_meta_data.Version
+}
+
+// commitFile records in the local index that a file of the base directory
+// is in sync with fileMetaData.
+func commitFile(client RPCClient, local_index LocalIndex, fileMetaData *FileMetaData) error {
+	local_FileStats := make(map[string]*FileStat)
+	if info, err := os.Lstat(ConcatPath(client.BaseDir, fileMetaData.Filename)); err == nil {
+		local_FileStats[fileMetaData.Filename] = NewFileStat(info)
+	}
+	if err := local_index.Put([]*FileMetaData{fileMetaData}, local_FileStats); err != nil {
+		return fmt.Errorf("update local index: %w", err)
+	}
+	return nil
+}
+
+func indexHashlists(fileMetas map[string]*FileMetaData) map[string][]string {
+	hashlists := make(map[string][]string, len(fileMetas))
+	for filename, fileMeta := range fileMetas {
+		if !IsDeleted(fileMeta) {
+			hashlists[filename] = fileMeta.BlockHashList
+		}
+	}
+	return hashlists
+}
@@ -0,0 +1,73 @@
+package surfstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreFile(t *testing.T) {
+	composed := "caf\u00e9.txt"
+	tests := []struct {
+		name     string
+		filename string // as typed by the user
+		version  int32
+		modified bool // the local copy has changes that were never synced
+		restored bool
+	}{
+		{"old version", composed, 1, false, true},
+		{"decomposed name", "cafe\u0301.txt", 1, false, true},
+		{"latest version", composed, 2, false, true},
+		{"missing version", composed, 5, false, false},
+		{"local changes", composed, 1, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(t, startTestServer(t))
+			path := filepath.Join(client.BaseDir, composed)
+			writeTestFiles(t, client, map[string]string{composed: "first"})
+			if err := os.Chmod(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			testSync(t, client)
+			writeTestFiles(t, client, map[string]string{composed: "second"})
+			if err := os.Chmod(path, 0644); err != nil {
+				t.Fatal(err)
+			}
+			testSync(t, client)
+			if test.modified {
+				writeTestFiles(t, client, map[string]string{composed: "third"})
+			}
+
+			err := RestoreFile(client, test.filename, test.version)
+			if (err == nil) != test.restored {
+				t.Fatalf("RestoreFile(%q, %d) = %v, want restored: %v", test.filename, test.version, err, test.restored)
+			}
+			var remote_FileInfoMap map[string]*FileMetaData
+			if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+				t.Fatal(err)
+			}
+			if !test.restored {
+				if remote_FileInfoMap[composed].GetVersion() != 2 {
+					t.Errorf("failed restore changed the server: %v", remote_FileInfoMap[composed])
+				}
+				return
+			}
+
+			want := map[int32]string{1: "first", 2: "second"}[test.version]
+			wantMode := map[int32]os.FileMode{1: 0755, 2: 0644}[test.version]
+			if content, err := os.ReadFile(path); err != nil || string(content) != want {
+				t.Errorf("restored %q, %v, want %q", content, err, want)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != wantMode {
+				t.Errorf("restored with mode %v, want %v", info.Mode().Perm(), wantMode)
+			}
+			if remote_FileInfoMap[composed].GetVersion() != 3 || len(remote_FileInfoMap) != 1 {
+				t.Errorf("restored as %v, want version 3 of %s", remote_FileInfoMap, composed)
+			}
+			if report := testSync(t, client); len(report.Files) != 0 {
+				t.Errorf("restored file synced again: %v", report.Files)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package surfstore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Filename Normalization Related
+*/
+
+// NormalizeFilename returns the canonical (NFC) form of a filename. A name
+// typed or stored decomposed, as macOS does, becomes the same key as the
+// composed one.
+func NormalizeFilename(filename string) string {
+	return norm.NFC.String(filename)
+}
+
+// IsNormalizedFilename reports whether filename is in its canonical form.
+func IsNormalizedFilename(filename string) bool {
+	return norm.NFC.IsNormalString(filename)
+}
+
+// NormalizeLocalFilenames renames the files of the base directory whose name
+// isn't normalized. A file is left as it is if sync_filter leaves it out
+// under either name, if the normalized name is taken by another file, or if
+// the filesystem already treats both names as the same file.
+func NormalizeLocalFilenames(client RPCClient, sync_filter *SyncFilter) error {
+	files, err := os.ReadDir(client.BaseDir)
+	if err != nil {
+		return fmt.Errorf("read base directory: %w", err)
+	}
+	for _, file := range files {
+		if IsNormalizedFilename(file.Name()) {
+			continue
+		} else if sync_filter.matched(file.Name(), file.IsDir()) || sync_filter.matched(NormalizeFilename(file.Name()), file.IsDir()) {
+			// the user asked for it not to be touched
+			continue
+		}
+		path := ConcatPath(client.BaseDir, file.Name())
+		normalized_path := ConcatPath(client.BaseDir, NormalizeFilename(file.Name()))
+		if normalized_info, err := os.Lstat(normalized_path); err == nil {
+			if info, err := os.Lstat(path); err != nil || !os.SameFile(info, normalized_info) {
+				log.Println("Another file has the normalized name, not renamed!", file.Name())
+			}
+			continue
+		}
+		if err := os.Rename(path, normalized_path); err != nil {
+			log.Println("Error occured when normalizing a filename!", err)
+		}
+	}
+	return nil
+}
+
+// MigrateRemoteFilenames renames the files on the server whose name isn't
+// normalized, left by older clients, and updates remote_FileInfoMap. A file
+// is left as it is if the normalized name is taken by another file.
+func MigrateRemoteFilenames(client RPCClient, remote_FileInfoMap map[string]*FileMetaData) {
+	filenames := make([]string, 0)
+	for filename, remote_meta_data := range remote_FileInfoMap {
+		if !IsNormalizedFilename(filename) && !IsDeleted(remote_meta_data) {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		remote_meta_data := remote_FileInfoMap[filename]
+		to := proto.Clone(remote_meta_data).(*FileMetaData)
+		to.Filename = NormalizeFilename(filename)
+		to.Version = 1
+		if other, ok := remote_FileInfoMap[to.Filename]; ok && !IsDeleted(other) {
+			log.Println("Another file has the normalized name, not migrated!", filename)
+			continue
+		} else if ok {
+			to.Version = other.Version + 1
+		}
+		from := NewTombstone(filename, remote_meta_data.Version+1)
+		var latestVersion int32
+		if err := client.RenameFile(from, to, &latestVersion); err != nil {
+			log.Println("Error occured when migrating a filename!", fmt.Errorf("rename %s to %s: %w", filename, to.Filename, err))
+			continue
+		}
+		to.RenamedFrom = filename
+		remote_FileInfoMap[filename] = from
+		remote_FileInfoMap[to.Filename] = to
+	}
+}
+
+// planNormalizedNames leaves out the downloads of files whose name isn't
+// normalized, which can't be stored locally under their key, and turns the
+// remote deletions of such files into index updates when the local file has
+// the normalized name, as deleting them could delete that file.
+func planNormalizedNames(plan *SyncPlan, local_FileInfoMap map[string]*FileMetaData) {
+	downloads := make([]*FileMetaData, 0, len(plan.Downloads))
+	for _, remote_meta_data := range plan.Downloads {
+		filename := remote_meta_data.Filename
+		if IsNormalizedFilename(filename) {
+			downloads = append(downloads, remote_meta_data)
+		} else if !IsDeleted(remote_meta_data) {
+			log.Println("Filename isn't normalized, not downloaded!", filename)
+		} else if local_meta_data, ok := local_FileInfoMap[NormalizeFilename(filename)]; ok && !IsDeleted(local_meta_data) {
+			plan.Unchanged = append(plan.Unchanged, remote_meta_data)
+		} else {
+			downloads = append(downloads, remote_meta_data)
+		}
+	}
+	sortMetaList(plan.Unchanged)
+	plan.Downloads = downloads
+}
@@ -0,0 +1,52 @@
+package surfstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncNormalizesFilenames(t *testing.T) {
+	decomposed, composed := "cafe\u0301.txt", "caf\u00e9.txt"
+	ignored := "note\u0301.tmp"
+	addr := startTestServer(t)
+	client := newTestClient(t, addr)
+	writeTestFiles(t, client, map[string]string{
+		IGNORE_FILENAME: "*.tmp\n",
+		decomposed:      "hello",
+		ignored:         "draft",
+	})
+
+	// a file uploaded under a decomposed name by an older client
+	old_client := newTestClient(t, addr)
+	var succ bool
+	var latestVersion int32
+	if err := old_client.PutBlock(&Block{BlockData: []byte("old"), BlockSize: 3}, addr, &succ); err != nil {
+		t.Fatal(err)
+	}
+	old_decomposed := "o\u0301ld"
+	if err := old_client.UpdateFile(&FileMetaData{Filename: old_decomposed, Version: 1, BlockHashList: []string{GetBlockHashString([]byte("old"))}}, &latestVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	testSync(t, client)
+
+	for filename, want := range map[string]bool{composed: true, decomposed: false, ignored: true, NormalizeFilename(ignored): false, NormalizeFilename(old_decomposed): true} {
+		if _, err := os.Lstat(filepath.Join(client.BaseDir, filename)); (err == nil) != want {
+			t.Errorf("%q on disk: %v, want %v", filename, err == nil, want)
+		}
+	}
+	var remote_FileInfoMap map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+		t.Fatal(err)
+	}
+	if remote_FileInfoMap[composed] == nil || remote_FileInfoMap[decomposed] != nil {
+		t.Errorf("uploaded under %v, want the normalized name", remote_FileInfoMap)
+	}
+	if !IsDeleted(remote_FileInfoMap[old_decomposed]) || remote_FileInfoMap[NormalizeFilename(old_decomposed)].GetRenamedFrom() != old_decomposed {
+		t.Errorf("remote file not migrated: %v", remote_FileInfoMap)
+	}
+	if remote_FileInfoMap[ignored] != nil || remote_FileInfoMap[NormalizeFilename(ignored)] != nil {
+		t.Errorf("ignored file uploaded")
+	}
+}
@@ -0,0 +1,207 @@
+package surfstore
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LocalBlockSource finds blocks that are already on this machine, either in
+// the files of the base directory or in an on-disk block cache, so a
+// download only fetches from the BlockStore the blocks that really changed.
+// Every block read locally is checked against its hash, so stale locations
+// (a file modified or replaced since it was hashed) are simply misses.
+type LocalBlockSource struct {
+	baseDir   string
+	blockSize int
+	locations map[string]fileBlockLocation
+	cache     *BlockCache
+}
+
+// fileBlockLocation is the position of a block in a file of the base directory.
+type fileBlockLocation struct {
+	filename string
+	index    int
+}
+
+// NewLocalBlockSource indexes the blocks of the local files from their hash
+// lists. cache may be nil.
+func NewLocalBlockSource(client RPCClient, local_Filehashlists map[string][]string, cache *BlockCache) *LocalBlockSource {
+	locations := make(map[string]fileBlockLocation)
+	for filename, hashlist := range local_Filehashlists {
+		for i, hash := range hashlist {
+			locations[hash] = fileBlockLocation{filename: filename, index: i}
+		}
+	}
+	return &LocalBlockSource{
+		baseDir:   client.BaseDir,
+		blockSize: client.BlockSize,
+		locations: locations,
+		cache:     cache,
+	}
+}
+
+// GetBlock returns the content of the block with the given hash, or nil if
+// it isn't available locally.
+func (src *LocalBlockSource) GetBlock(hash string) []byte {
+	if src == nil {
+		return nil
+	}
+	if location, ok := src.locations[hash]; ok {
+		if data := src.readFileBlock(location); data != nil && GetBlockHashString(data) == hash {
+			return data
+		}
+	}
+	return src.cache.Get(hash)
+}
+
+// AddBlock keeps a block fetched from the BlockStore in the block cache.
+func (src *LocalBlockSource) AddBlock(hash string, data []byte) {
+	if src == nil {
+		return
+	}
+	if err := src.cache.Put(hash, data); err != nil {
+		log.Println("Error occured when caching block!", err)
+	}
+}
+
+func (src *LocalBlockSource) readFileBlock(location fileBlockLocation) []byte {
+	f, err := os.Open(ConcatPath(src.baseDir, location.filename))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	data := make([]byte, src.blockSize)
+	bytes, err := f.ReadAt(data, int64(location.index)*int64(src.blockSize))
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	return data[:bytes]
+}
+
+/*
+	Block Cache Related
+*/
+
+// BlockCache is an on-disk cache of blocks, one file per block named by its
+// hash. When the cache grows over its size cap, the least recently used
+// blocks are evicted.
+type BlockCache struct {
+	dir     string
+	maxSize int64
+	mutex   sync.Mutex
+	size    int64
+	entries map[string]*blockCacheEntry
+}
+
+type blockCacheEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// OpenBlockCache opens (or creates) the block cache in dir, holding at most
+// maxSize bytes of blocks.
+func OpenBlockCache(dir string, maxSize int64) (*BlockCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &BlockCache{dir: dir, maxSize: maxSize, entries: make(map[string]*blockCacheEntry)}
+	for _, file := range files {
+		if IsTempFile(file.Name()) {
+			// left by an interrupted Put
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || !info.Mode().IsRegular() || !isValidBlockHash(file.Name()) {
+			continue
+		}
+		cache.entries[file.Name()] = &blockCacheEntry{size: info.Size(), lastUsed: info.ModTime()}
+		cache.size += info.Size()
+	}
+	cache.evict()
+	return cache, nil
+}
+
+// Get returns the cached content of the block with the given hash, or nil.
+func (c *BlockCache) Get(hash string) []byte {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	entry, ok := c.entries[hash]
+	c.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, hash))
+	if err != nil || GetBlockHashString(data) != hash {
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(filepath.Join(c.dir, hash), now, now)
+	c.mutex.Lock()
+	entry.lastUsed = now
+	c.mutex.Unlock()
+	return data
+}
+
+// Put adds a block to the cache, evicting old blocks if needed.
+func (c *BlockCache) Put(hash string, data []byte) error {
+	if c == nil || int64(len(data)) > c.maxSize {
+		return nil
+	}
+	c.mutex.Lock()
+	_, ok := c.entries[hash]
+	c.mutex.Unlock()
+	if ok {
+		return nil
+	}
+
+	if err := WriteFileAtomic(filepath.Join(c.dir, hash), data, 0644); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[hash]; !ok {
+		c.entries[hash] = &blockCacheEntry{size: int64(len(data)), lastUsed: time.Now()}
+		c.size += int64(len(data))
+	}
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used blocks until the cache fits in its
+// size cap. The caller must hold the mutex (or be the only user).
+func (c *BlockCache) evict() {
+	if c.size <= c.maxSize {
+		return
+	}
+	hashes := make([]string, 0, len(c.entries))
+	for hash := range c.entries {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return c.entries[hashes[i]].lastUsed.Before(c.entries[hashes[j]].lastUsed)
+	})
+	for _, hash := range hashes {
+		if c.size <= c.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, hash)); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		c.size -= c.entries[hash].size
+		delete(c.entries, hash)
+	}
+}
@@ -0,0 +1,293 @@
+package surfstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// FileStat is the stat data of a local file at the time its entry was
+// recorded in the local index. If a file still has the same stat data, its
+// content (and so its block hash list) hasn't changed.
+type FileStat struct {
+	Size    int64
+	ModTime int64 // nanoseconds since the Unix epoch
+	Inode   uint64
+	Mode    uint32 // permission bits, not recorded in the index (the FileMetaData has them)
+
+	// target of a symlink, "" for a regular file, not recorded in the index either
+	LinkTarget string
+	// hex SHA-256 of the content when it was hashed, "" if unknown, not
+	// recorded in the index either (the FileMetaData has it)
+	ContentHash string
+}
+
+func NewFileStat(info os.FileInfo) *FileStat {
+	return &FileStat{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   fileInode(info),
+		Mode:    uint32(info.Mode().Perm()),
+	}
+}
+
+// Unchanged reports whether two stat data describe the same file content.
+func (fs *FileStat) Unchanged(other *FileStat) bool {
+	return fs != nil && other != nil && fs.Size == other.Size && fs.ModTime == other.ModTime && fs.Inode == other.Inode
+}
+
+// LocalIndex records the files of the base directory that are in sync with
+// the server, and the stat data of their local copies.
+type LocalIndex interface {
+	// Load returns every entry of the index, keyed by filename.
+	Load() (fileMetas map[string]*FileMetaData, fileStats map[string]*FileStat, err error)
+
+	// Put adds or replaces the entries of the given files, leaving the other
+	// entries untouched. A file missing from fileStats is stored without stat data.
+	Put(fileMetas []*FileMetaData, fileStats map[string]*FileStat) error
+
+	// Release the resources held by the index
+	Close() error
+}
+
+// OpenLocalIndex opens the local index of the client's base directory,
+// using the backend selected by client.IndexType.
+func OpenLocalIndex(client RPCClient) (LocalIndex, error) {
+	switch client.IndexType {
+	case "", INDEX_TYPE_TEXT:
+		return &TextLocalIndex{MetaFilePath: ConcatPath(client.BaseDir, DEFAULT_META_FILENAME)}, nil
+	case INDEX_TYPE_BOLT:
+		return OpenBoltLocalIndex(ConcatPath(client.BaseDir, DEFAULT_META_DB_FILENAME), ConcatPath(client.BaseDir, DEFAULT_META_FILENAME))
+	default:
+		return nil, fmt.Errorf("unknown index type %q", client.IndexType)
+	}
+}
+
+// IsIndexFile reports whether filename is used by the client to keep its
+// sync state (a local index backend or the transfer journal) or its local
+// configuration, which are never synced.
+func IsIndexFile(filename string) bool {
+	return filename == DEFAULT_META_FILENAME || filename == DEFAULT_META_LOG_FILENAME || filename == DEFAULT_META_DB_FILENAME || filename == DEFAULT_JOURNAL_FILENAME || filename == INCLUDE_FILENAME
+}
+
+/*
+	index.txt
+*/
+
+// TextLocalIndex keeps the index in index.txt. A Put appends the changed
+// entries to index.log instead of rewriting index.txt, so committing a file
+// costs the same however many files the index has; the log is folded into
+// index.txt by Close, or by Load if a crash left it torn.
+type TextLocalIndex struct {
+	MetaFilePath string
+	fileMetas    map[string]*FileMetaData
+	fileStats    map[string]*FileStat
+	logFile      *os.File // open for appending once something is put
+	logged       bool     // index.log has commits not in index.txt yet
+}
+
+func (idx *TextLocalIndex) Load() (map[string]*FileMetaData, map[string]*FileStat, error) {
+	fileMetas, fileStats, torn, err := loadTextIndex(idx.MetaFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx.fileMetas, idx.fileStats = fileMetas, fileStats
+	_, statErr := os.Stat(metaLogPath(idx.MetaFilePath))
+	idx.logged = statErr == nil
+	if torn {
+		// appending after the torn commit would hide the next ones
+		if err := idx.compact(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return copyMetaMap(fileMetas), copyStatMap(fileStats), nil
+}
+
+func (idx *TextLocalIndex) Put(fileMetas []*FileMetaData, fileStats map[string]*FileStat) error {
+	if idx.fileMetas == nil {
+		if _, _, err := idx.Load(); err != nil {
+			return err
+		}
+	}
+	if idx.logFile == nil {
+		logFile, err := os.OpenFile(metaLogPath(idx.MetaFilePath), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(idx.MetaFilePath)); err != nil {
+			logFile.Close()
+			return err
+		}
+		idx.logFile = logFile
+	}
+
+	var entries strings.Builder
+	for _, fileMeta := range fileMetas {
+		idx.fileMetas[fileMeta.Filename] = fileMeta
+		if fileStat, ok := fileStats[fileMeta.Filename]; ok {
+			idx.fileStats[fileMeta.Filename] = fileStat
+		} else {
+			delete(idx.fileStats, fileMeta.Filename)
+		}
+		entries.WriteString(indexEntryToString(fileMeta, fileStats[fileMeta.Filename]))
+	}
+	entries.WriteString(META_CHECKSUM_PREFIX + GetBlockHashString([]byte(entries.String())) + "\n")
+	idx.logged = true
+	if _, err := idx.logFile.WriteString(entries.String()); err != nil {
+		return err
+	}
+	return idx.logFile.Sync()
+}
+
+// Close folds the commit log into index.txt.
+func (idx *TextLocalIndex) Close() error {
+	if idx.fileMetas == nil || !idx.logged {
+		return nil
+	}
+	return idx.compact()
+}
+
+// compact writes every entry to index.txt and removes the commit log. A
+// crash before the log is removed only replays commits already in index.txt.
+func (idx *TextLocalIndex) compact() error {
+	if idx.logFile != nil {
+		idx.logFile.Close()
+		idx.logFile = nil
+	}
+	if err := writeMetaFile(idx.MetaFilePath, idx.fileMetas, idx.fileStats); err != nil {
+		return err
+	}
+	if err := os.Remove(metaLogPath(idx.MetaFilePath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	idx.logged = false
+	return nil
+}
+
+/*
+	index.db
+*/
+
+var boltFilesBucket = []byte("files")
+
+// BoltLocalIndex keeps the index in an embedded bbolt database, one key per
+// file, so a Put only writes the entries that changed. Values use the same
+// encoding as the lines of index.txt.
+type BoltLocalIndex struct {
+	db *bolt.DB
+}
+
+// OpenBoltLocalIndex opens (or creates) the database at dbPath. A new
+// database is seeded from the text index at metaFilePath if there is one,
+// so switching backends keeps the sync state.
+func OpenBoltLocalIndex(dbPath string, metaFilePath string) (*BoltLocalIndex, error) {
+	_, statErr := os.Stat(dbPath)
+	db, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: DB_LOCK_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	idx := &BoltLocalIndex{db: db}
+
+	// a write transaction is only made if the bucket is missing, opening
+	// the index of a sync with nothing to do doesn't write to it
+	var bucket_exists bool
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket_exists = tx.Bucket(boltFilesBucket) != nil
+		return nil
+	})
+	if err == nil && !bucket_exists {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltFilesBucket)
+			return err
+		})
+	}
+	if err == nil && os.IsNotExist(statErr) {
+		var fileMetas map[string]*FileMetaData
+		var fileStats map[string]*FileStat
+		fileMetas, fileStats, _, err = loadTextIndex(metaFilePath)
+		if err == nil {
+			err = idx.Put(metaMapValues(fileMetas), fileStats)
+		}
+	}
+	if err != nil {
+		db.Close()
+		os.Remove(dbPath)
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *BoltLocalIndex) Load() (map[string]*FileMetaData, map[string]*FileStat, error) {
+	fileMetas := make(map[string]*FileMetaData)
+	fileStats := make(map[string]*FileStat)
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltFilesBucket).ForEach(func(k, v []byte) error {
+			fileMeta, fileStat, err := parseIndexEntry(string(v))
+			if err != nil {
+				return fmt.Errorf("corrupted entry %q in %s: %w", k, idx.db.Path(), err)
+			}
+			fileMetas[fileMeta.Filename] = fileMeta
+			if fileStat != nil {
+				fileStats[fileMeta.Filename] = fileStat
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return fileMetas, fileStats, nil
+}
+
+func (idx *BoltLocalIndex) Put(fileMetas []*FileMetaData, fileStats map[string]*FileStat) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltFilesBucket)
+		for _, fileMeta := range fileMetas {
+			entry := indexEntryToString(fileMeta, fileStats[fileMeta.Filename])
+			err := bucket.Put([]byte(fileMeta.Filename), []byte(entry[:len(entry)-1]))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (idx *BoltLocalIndex) Close() error {
+	return idx.db.Close()
+}
+
+// This line guarantees all method for the local indexes are implemented
+var _ LocalIndex = new(TextLocalIndex)
+var _ LocalIndex = new(BoltLocalIndex)
+
+/*
+	Map Related
+*/
+
+func copyMetaMap(fileMetas map[string]*FileMetaData) map[string]*FileMetaData {
+	copied := make(map[string]*FileMetaData, len(fileMetas))
+	for filename, fileMeta := range fileMetas {
+		copied[filename] = fileMeta
+	}
+	return copied
+}
+
+func copyStatMap(fileStats map[string]*FileStat) map[string]*FileStat {
+	copied := make(map[string]*FileStat, len(fileStats))
+	for filename, fileStat := range fileStats {
+		copied[filename] = fileStat
+	}
+	return copied
+}
+
+func metaMapValues(fileMetas map[string]*FileMetaData) []*FileMetaData {
+	values := make([]*FileMetaData, 0, len(fileMetas))
+	for _, fileMeta := range fileMetas {
+		values = append(values, fileMeta)
+	}
+	return values
+}
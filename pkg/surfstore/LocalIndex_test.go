@@ -0,0 +1,114 @@
+package surfstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTextLocalIndex(t *testing.T) {
+	a1 := &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}}
+	a2 := &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{hashB}}
+	b1 := &FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{hashB}}
+	c1 := &FileMetaData{Filename: "c", Version: 1, BlockHashList: []string{hashA}}
+	stats := map[string]*FileStat{"a": {Size: 1, ModTime: 2, Inode: 3}}
+
+	tests := []struct {
+		name  string
+		puts  [][]*FileMetaData
+		close bool             // fold the log into index.txt
+		tear  string           // appended to the log before loading it again
+		files map[string]int32 // version of each file loaded again
+	}{
+		{"nothing put", nil, true, "", map[string]int32{}},
+		{"replayed", [][]*FileMetaData{{a1, b1}, {a2}}, false, "", map[string]int32{"a": 2, "b": 1}},
+		{"compacted", [][]*FileMetaData{{a1, b1}, {a2}}, true, "", map[string]int32{"a": 2, "b": 1}},
+		{"torn entry", [][]*FileMetaData{{a1}}, false, "b,1,", map[string]int32{"a": 1}},
+		{"torn commit", [][]*FileMetaData{{a1}}, false, indexEntryToString(c1, nil), map[string]int32{"a": 1}},
+		{"bad checksum", [][]*FileMetaData{{a1}}, false, indexEntryToString(c1, nil) + META_CHECKSUM_PREFIX + hashA + "\n", map[string]int32{"a": 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metaFilePath := filepath.Join(t.TempDir(), DEFAULT_META_FILENAME)
+			logFilePath := metaLogPath(metaFilePath)
+			idx := &TextLocalIndex{MetaFilePath: metaFilePath}
+			if _, _, err := idx.Load(); err != nil {
+				t.Fatal(err)
+			}
+			for _, put := range test.puts {
+				if err := idx.Put(put, stats); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.close {
+				if err := idx.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := os.Stat(logFilePath); !os.IsNotExist(err) {
+					t.Errorf("log not removed by Close: %v", err)
+				}
+			}
+			if test.tear != "" {
+				f, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteString(test.tear)
+				f.Close()
+			}
+
+			reopened := &TextLocalIndex{MetaFilePath: metaFilePath}
+			fileMetas, fileStats, err := reopened.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fileMetas) != len(test.files) {
+				t.Errorf("loaded %d files, want %d", len(fileMetas), len(test.files))
+			}
+			for filename, version := range test.files {
+				if fileMetas[filename].GetVersion() != version {
+					t.Errorf("loaded %s %v, want version %d", filename, fileMetas[filename], version)
+				}
+			}
+			if _, ok := test.files["a"]; ok && (fileStats["a"] == nil || *fileStats["a"] != *stats["a"]) {
+				t.Errorf("loaded stat %v, want %v", fileStats["a"], stats["a"])
+			}
+			if test.tear != "" {
+				// a torn log is folded right away, so the next commits aren't lost behind it
+				if _, err := os.Stat(logFilePath); !os.IsNotExist(err) {
+					t.Errorf("torn log not compacted: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestBoltLocalIndexSeededFromTextIndex(t *testing.T) {
+	baseDir := t.TempDir()
+	text := &TextLocalIndex{MetaFilePath: filepath.Join(baseDir, DEFAULT_META_FILENAME)}
+	a1 := &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}}
+	b1 := &FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{hashB}}
+	if err := text.Put([]*FileMetaData{a1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := text.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// only in the log
+	if err := text.Put([]*FileMetaData{b1}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bolt, err := OpenBoltLocalIndex(filepath.Join(baseDir, DEFAULT_META_DB_FILENAME), text.MetaFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	fileMetas, _, err := bolt.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileMetas["a"].GetVersion() != 1 || fileMetas["b"].GetVersion() != 1 {
+		t.Errorf("seeded %v, want a and b", fileMetas)
+	}
+}
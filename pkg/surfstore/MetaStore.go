@@ -4,13 +4,24 @@ import (
 	context "context"
 	"sync"
 
+	"google.golang.org/grpc/codes"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type MetaStore struct {
 	FileMetaMap    map[string]*FileMetaData
+	FileHistoryMap map[string][]*FileMetaData // every version of each file, oldest first
 	BlockStoreAddr string
 	mutex          sync.Mutex
+
+	// reject new files whose name differs only in case from an existing one,
+	// as they collide on case-insensitive filesystems
+	RejectCaseDuplicates bool
+
+	// NORMALIZATION_NONE (default), NORMALIZATION_REJECT or NORMALIZATION_NFC.
+	// Files already stored under a name that isn't normalized can still be
+	// updated, deleted and renamed.
+	FilenameNormalization string
 	UnimplementedMetaStoreServer
 }
 
@@ -23,19 +34,55 @@ func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*File
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	return m.updateFile(fileMetaData, nil)
+}
+
+// UpdateFileIf is UpdateFile with the version the client expects the file
+// to have, so two clients creating the same file can't both succeed.
+func (m *MetaStore) UpdateFileIf(ctx context.Context, fileUpdate *FileUpdate) (*Version, error) {
+	if fileUpdate.File == nil {
+		return nil, statusError(codes.InvalidArgument, "Invalid update", "missing file", nil)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	expected_version := fileUpdate.ExpectedVersion
+	return m.updateFile(fileUpdate.File, &expected_version)
+}
+
+// updateFile stores a new version of a file, which must follow the current
+// one, or a new file with any version. If expected_version isn't nil, the
+// current version must also be *expected_version, 0 if there is none.
+func (m *MetaStore) updateFile(fileMetaData *FileMetaData, expected_version *int32) (*Version, error) {
+	// older clients only send the "0" hash list of a deleted file
+	NormalizeTombstone(fileMetaData)
+	if err := m.normalizeFilename(fileMetaData); err != nil {
+		return nil, err
+	}
 	filename := (*fileMetaData).Filename
 	rmt_meta_data, ok := m.FileMetaMap[filename]
+	if expected_version != nil && *expected_version != rmt_meta_data.GetVersion() {
+		// created or changed by another client
+		return nil, versionConflictError(filename, fileMetaData.Version, rmt_meta_data)
+	}
 	if ok {
 		// update
-		if fileMetaData.Version == rmt_meta_data.Version+1 {
+		if other, ok := m.caseDuplicate(fileMetaData); ok && IsDeleted(rmt_meta_data) {
+			// recreated
+			return nil, statusError(codes.AlreadyExists, "Name differs only in case from", other, nil)
+		} else if fileMetaData.Version == rmt_meta_data.Version+1 {
 			m.FileMetaMap[filename] = fileMetaData
+			m.FileHistoryMap[filename] = append(m.FileHistoryMap[filename], fileMetaData)
 			return &Version{Version: fileMetaData.Version}, nil
 		} else {
-			return nil, badStringError("Invalid version", string(fileMetaData.Version))
+			return nil, versionConflictError(filename, fileMetaData.Version, rmt_meta_data)
 		}
 	} else {
 		// new
+		if other, ok := m.caseDuplicate(fileMetaData); ok {
+			return nil, statusError(codes.AlreadyExists, "Name differs only in case from", other, nil)
+		}
 		m.FileMetaMap[filename] = fileMetaData
+		m.FileHistoryMap[filename] = append(m.FileHistoryMap[filename], fileMetaData)
 		return &Version{Version: fileMetaData.Version}, nil
 	}
 }
@@ -46,12 +93,95 @@ func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*B
 	return &BlockStoreAddr{Addr: m.BlockStoreAddr}, nil
 }
 
+func (m *MetaStore) GetFileHistory(ctx context.Context, fileName *FileName) (*FileHistory, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	versions, ok := m.FileHistoryMap[fileName.Filename]
+	if !ok {
+		return nil, fileNotFoundError(fileName.Filename)
+	}
+	return &FileHistory{Versions: append([]*FileMetaData{}, versions...)}, nil
+}
+
+// RenameFile deletes a file and creates (or recreates) another one with its
+// content at once. Both versions are checked like in UpdateFile, the file
+// renamed must exist and the new name must be free.
+func (m *MetaStore) RenameFile(ctx context.Context, fileRename *FileRename) (*Version, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	from, to := fileRename.From, fileRename.To
+	if from == nil || to == nil {
+		return nil, statusError(codes.InvalidArgument, "Invalid rename", "missing file", nil)
+	}
+	NormalizeTombstone(from)
+	NormalizeTombstone(to)
+	if err := m.normalizeFilename(to); err != nil {
+		return nil, err
+	}
+	if from.Filename == to.Filename || !IsDeleted(from) || IsDeleted(to) {
+		return nil, statusError(codes.InvalidArgument, "Invalid rename", from.Filename+" -> "+to.Filename, nil)
+	}
+	rmt_from, ok := m.FileMetaMap[from.Filename]
+	if !ok || IsDeleted(rmt_from) {
+		return nil, fileNotFoundError(from.Filename)
+	} else if from.Version != rmt_from.Version+1 {
+		return nil, versionConflictError(from.Filename, from.Version, rmt_from)
+	}
+	if rmt_to, ok := m.FileMetaMap[to.Filename]; ok && !IsDeleted(rmt_to) {
+		return nil, statusError(codes.AlreadyExists, "File exists", to.Filename, &FileName{Filename: to.Filename})
+	} else if ok && to.Version != rmt_to.Version+1 {
+		return nil, versionConflictError(to.Filename, to.Version, rmt_to)
+	} else if other, ok := m.caseDuplicate(to); ok && other != from.Filename {
+		return nil, statusError(codes.AlreadyExists, "Name differs only in case from", other, nil)
+	}
+
+	to.RenamedFrom = from.Filename
+	for _, fileMetaData := range []*FileMetaData{from, to} {
+		m.FileMetaMap[fileMetaData.Filename] = fileMetaData
+		m.FileHistoryMap[fileMetaData.Filename] = append(m.FileHistoryMap[fileMetaData.Filename], fileMetaData)
+	}
+	return &Version{Version: to.Version}, nil
+}
+
+// normalizeFilename applies FilenameNormalization to the name of a file
+// that isn't stored yet.
+func (m *MetaStore) normalizeFilename(fileMetaData *FileMetaData) error {
+	if IsNormalizedFilename(fileMetaData.Filename) {
+		return nil
+	} else if _, ok := m.FileMetaMap[fileMetaData.Filename]; ok {
+		return nil
+	}
+	switch m.FilenameNormalization {
+	case NORMALIZATION_REJECT:
+		return statusError(codes.InvalidArgument, "Filename isn't normalized (NFC)", fileMetaData.Filename, nil)
+	case NORMALIZATION_NFC:
+		fileMetaData.Filename = NormalizeFilename(fileMetaData.Filename)
+	}
+	return nil
+}
+
+// caseDuplicate returns the existing file whose name differs only in case
+// from a new file, if RejectCaseDuplicates is set. Deleted files don't count.
+func (m *MetaStore) caseDuplicate(fileMetaData *FileMetaData) (string, bool) {
+	if !m.RejectCaseDuplicates || IsDeleted(fileMetaData) {
+		return "", false
+	}
+	key := CaseFoldKey(fileMetaData.Filename)
+	for filename, rmt_meta_data := range m.FileMetaMap {
+		if filename != fileMetaData.Filename && !IsDeleted(rmt_meta_data) && CaseFoldKey(filename) == key {
+			return filename, true
+		}
+	}
+	return "", false
+}
+
 // This line guarantees all method for MetaStore are implemented
 var _ MetaStoreInterface = new(MetaStore)
 
 func NewMetaStore(blockStoreAddr string) *MetaStore {
 	return &MetaStore{
 		FileMetaMap:    map[string]*FileMetaData{},
+		FileHistoryMap: map[string][]*FileMetaData{},
 		BlockStoreAddr: blockStoreAddr,
 	}
 }
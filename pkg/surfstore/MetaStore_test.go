@@ -0,0 +1,156 @@
+package surfstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestMetaStore returns a MetaStore with "a" at version 1, and "gone"
+// deleted at version 2.
+func newTestMetaStore() *MetaStore {
+	m := NewMetaStore("localhost:8081")
+	for _, fileMetaData := range []*FileMetaData{
+		{Filename: "a", Version: 1, BlockHashList: []string{hashA}},
+		{Filename: "gone", Version: 1, BlockHashList: []string{hashB}},
+		NewTombstone("gone", 2),
+	} {
+		if _, err := m.UpdateFile(context.Background(), fileMetaData); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+func TestRenameFile(t *testing.T) {
+	file := func(filename string, version int32) *FileMetaData {
+		return &FileMetaData{Filename: filename, Version: version, BlockHashList: []string{hashA}}
+	}
+	tests := []struct {
+		name   string
+		rename *FileRename
+		code   codes.Code
+	}{
+		{"rename", &FileRename{From: NewTombstone("a", 2), To: file("b", 1)}, codes.OK},
+		{"rename over a deleted file", &FileRename{From: NewTombstone("a", 2), To: file("gone", 3)}, codes.OK},
+		{"missing file", &FileRename{From: NewTombstone("a", 2)}, codes.InvalidArgument},
+		{"same name", &FileRename{From: NewTombstone("a", 2), To: file("a", 3)}, codes.InvalidArgument},
+		{"renamed file not deleted", &FileRename{From: file("a", 2), To: file("b", 1)}, codes.InvalidArgument},
+		{"new file deleted", &FileRename{From: NewTombstone("a", 2), To: NewTombstone("b", 1)}, codes.InvalidArgument},
+		{"unknown file", &FileRename{From: NewTombstone("c", 2), To: file("b", 1)}, codes.NotFound},
+		{"deleted file", &FileRename{From: NewTombstone("gone", 3), To: file("b", 1)}, codes.NotFound},
+		{"old version", &FileRename{From: NewTombstone("a", 1), To: file("b", 1)}, codes.FailedPrecondition},
+		{"new name taken", &FileRename{From: NewTombstone("a", 2), To: file("a2", 1)}, codes.AlreadyExists},
+		{"old version of the deleted file", &FileRename{From: NewTombstone("a", 2), To: file("gone", 2)}, codes.FailedPrecondition},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestMetaStore()
+			if _, err := m.UpdateFile(context.Background(), file("a2", 1)); err != nil {
+				t.Fatal(err)
+			}
+			_, err := m.RenameFile(context.Background(), test.rename)
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %v (%v), want %v", code, err, test.code)
+			}
+			if test.code != codes.OK {
+				if m.FileMetaMap["a"].Version != 1 || !m.FileMetaMap["gone"].Deleted {
+					t.Errorf("rejected rename changed the files")
+				}
+				return
+			}
+			from, to := m.FileMetaMap[test.rename.From.Filename], m.FileMetaMap[test.rename.To.Filename]
+			if !IsDeleted(from) || from.Version != test.rename.From.Version {
+				t.Errorf("renamed file is %v, want it deleted", from)
+			}
+			if to.RenamedFrom != test.rename.From.Filename || !CompareHashlist(to.BlockHashList, []string{hashA}) {
+				t.Errorf("new file is %v, want it renamed from %s", to, test.rename.From.Filename)
+			}
+		})
+	}
+}
+
+func TestUpdateFileCaseDuplicates(t *testing.T) {
+	tests := []struct {
+		name string
+		file *FileMetaData
+		code codes.Code
+	}{
+		{"new name differing only in case", &FileMetaData{Filename: "A", Version: 1, BlockHashList: []string{hashB}}, codes.AlreadyExists},
+		{"deleted file differing only in case", &FileMetaData{Filename: "Gone", Version: 1, BlockHashList: []string{hashB}}, codes.OK},
+		{"other name", &FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{hashB}}, codes.OK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestMetaStore()
+			m.RejectCaseDuplicates = true
+			_, err := m.UpdateFile(context.Background(), test.file)
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %v (%v), want %v", code, err, test.code)
+			}
+		})
+	}
+}
+
+func TestUpdateFile(t *testing.T) {
+	none := int32(-1) // updateFile without an expected version
+	tests := []struct {
+		name            string
+		file            *FileMetaData
+		expectedVersion int32
+		code            codes.Code
+		currentVersion  int32 // in the version conflict
+	}{
+		{"new file", &FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{hashB}}, none, codes.OK, 0},
+		{"new file with any version", &FileMetaData{Filename: "b", Version: 7, BlockHashList: []string{hashB}}, none, codes.OK, 0},
+		{"next version", &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{hashB}}, none, codes.OK, 0},
+		{"same version", &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashB}}, none, codes.FailedPrecondition, 1},
+		{"version skipped", &FileMetaData{Filename: "a", Version: 3, BlockHashList: []string{hashB}}, none, codes.FailedPrecondition, 1},
+		{"deletion", NewTombstone("a", 2), none, codes.OK, 0},
+		{"recreation", &FileMetaData{Filename: "gone", Version: 3, BlockHashList: []string{hashA}}, none, codes.OK, 0},
+		{"creation expected", &FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{hashB}}, NO_FILE_VERSION, codes.OK, 0},
+		{"creation race", &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashB}}, NO_FILE_VERSION, codes.FailedPrecondition, 1},
+		{"expected version", &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{hashB}}, 1, codes.OK, 0},
+		{"unexpected version", &FileMetaData{Filename: "a", Version: 3, BlockHashList: []string{hashB}}, 2, codes.FailedPrecondition, 1},
+		{"expected version of a missing file", &FileMetaData{Filename: "b", Version: 2, BlockHashList: []string{hashB}}, 1, codes.FailedPrecondition, 0},
+		{"recreation expected", &FileMetaData{Filename: "gone", Version: 3, BlockHashList: []string{hashA}}, 2, codes.OK, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestMetaStore()
+			var err error
+			if test.expectedVersion == none {
+				_, err = m.UpdateFile(context.Background(), test.file)
+			} else {
+				_, err = m.UpdateFileIf(context.Background(), &FileUpdate{File: test.file, ExpectedVersion: test.expectedVersion})
+			}
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %v (%v), want %v", code, err, test.code)
+			}
+
+			stored := m.FileMetaMap[test.file.Filename]
+			if test.code == codes.OK {
+				if stored != test.file {
+					t.Errorf("stored %v, want %v", stored, test.file)
+				}
+				return
+			}
+			if stored == test.file {
+				t.Errorf("rejected update stored")
+			}
+			var conflict *VersionConflictError
+			if !errors.As(fromStatus(err), &conflict) {
+				t.Fatalf("got %v, want a VersionConflictError", fromStatus(err))
+			}
+			if conflict.Version != test.file.Version || conflict.CurrentVersion != test.currentVersion {
+				t.Errorf("got conflict on version %d with current version %d, want %d and %d", conflict.Version, conflict.CurrentVersion, test.file.Version, test.currentVersion)
+			}
+			if conflict.Current.GetVersion() != test.currentVersion {
+				t.Errorf("got current file %v, want version %d", conflict.Current, test.currentVersion)
+			}
+		})
+	}
+}
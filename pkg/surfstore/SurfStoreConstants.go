@@ -1,6 +1,22 @@
 package surfstore
 
+import "time"
+
 const DEFAULT_META_FILENAME string = "index.txt"
+const DEFAULT_META_LOG_FILENAME string = "index.log"
+const DEFAULT_META_DB_FILENAME string = "index.db"
+const DEFAULT_JOURNAL_FILENAME string = "index.journal"
+
+// patterns of the files a client doesn't sync (synced like any other file),
+// and of the only files it syncs (local to the client)
+const IGNORE_FILENAME string = ".surfignore"
+const INCLUDE_FILENAME string = ".surfinclude"
+
+// block hash list of a deleted file, understood by every client
+const TOMBSTONE_HASH string = "0"
+
+// prefix of temporary files used for atomic writes in the base directory
+const TMP_FILE_PREFIX string = ".surfstore-tmp-"
 
 const FILENAME_INDEX int = 0
 const VERSION_INDEX int = 1
@@ -8,3 +24,74 @@ const HASH_LIST_INDEX int = 2
 
 const CONFIG_DELIMITER string = ","
 const HASH_DELIMITER string = " "
+
+// local metadata file format, see LoadMetaFromMetaFile
+const META_FORMAT_VERSION int = 2
+const META_HEADER_PREFIX string = "# surfstore index v"
+const META_CHECKSUM_PREFIX string = "# sha256 "
+
+// extra fields of an index entry holding the file's stat data
+const STAT_SIZE_KEY string = "size"
+const STAT_MTIME_KEY string = "mtime"
+const STAT_INODE_KEY string = "inode"
+
+// keys of the optional file attributes in the metadata file
+const META_MODE_KEY string = "mode"
+const META_MTIME_KEY string = "modtime"
+const META_TYPE_KEY string = "type"
+const META_TARGET_KEY string = "target"
+const META_CONTENT_HASH_KEY string = "sha256"
+const META_TYPE_SYMLINK string = "symlink"
+
+// what the client does with the symlinks pointing outside of the base directory
+const SYMLINK_POLICY_SKIP string = "skip"     // leave them out of the sync
+const SYMLINK_POLICY_KEEP string = "keep"     // sync them as symlinks
+const SYMLINK_POLICY_FOLLOW string = "follow" // upload the files they point to, skip remote ones
+
+// what a client on a case-insensitive filesystem does with a remote file
+// whose name differs only in case from another one
+const CASE_POLICY_SKIP string = "skip"     // don't download it
+const CASE_POLICY_RENAME string = "rename" // rename it on the server with a suffix, for every client, then download it
+const CASE_POLICY_ERROR string = "error"   // stop the sync before transferring any file (local filenames may already be normalized)
+
+// suffix added to the name of a file renamed by CASE_POLICY_RENAME, before its extension
+const CASE_CONFLICT_SUFFIX string = " (case conflict)"
+
+// suffix added to the name of a local file whose upload was rejected because
+// the file changed on the server, before its extension
+const CONFLICTED_COPY_SUFFIX string = " (conflicted copy)"
+
+// what the MetaStore does with a new filename that isn't normalized (NFC)
+const NORMALIZATION_NONE string = "none"     // store it as it is
+const NORMALIZATION_REJECT string = "reject" // reject the update
+const NORMALIZATION_NFC string = "nfc"       // store it under its normalized form
+
+// expected version of an update creating a file that must not exist on the server
+const NO_FILE_VERSION int32 = 0
+
+// what a sync did to a file, see FileResult
+const SYNC_ACTION_DOWNLOAD string = "download"
+const SYNC_ACTION_DELETE_LOCAL string = "delete locally"
+const SYNC_ACTION_UPLOAD string = "upload"
+const SYNC_ACTION_DELETE_REMOTE string = "delete remotely"
+const SYNC_ACTION_RENAME_LOCAL string = "rename locally"
+const SYNC_ACTION_RENAME_REMOTE string = "rename remotely"
+const SYNC_ACTION_CONFLICT string = "conflict" // changed on both sides, the remote version replaced it, or it changed on the server during the upload and local changes were kept in a copy
+const SYNC_ACTION_SKIP string = "skip"         // left out of the sync: a case collision, or a symlink left out by the symlink policy
+
+// local index backends
+const INDEX_TYPE_TEXT string = "text"
+const INDEX_TYPE_BOLT string = "bolt"
+
+// how long to wait for another client holding the index.db lock
+const DB_LOCK_TIMEOUT time.Duration = time.Second
+
+// default number of concurrent hashing and transfer workers of a client
+const DEFAULT_CONCURRENCY int = 8
+
+// blocks kept in memory by each file transferred by a sync, the sync
+// transfers as many files in parallel as it has workers
+const TRANSFER_WINDOW_PER_WORKER int = 4
+
+// hashes sent in a single HasBlocks call
+const HAS_BLOCKS_BATCH_SIZE int = 1024
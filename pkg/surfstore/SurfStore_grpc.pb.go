@@ -180,6 +180,9 @@ type MetaStoreClient interface {
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
 	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	GetFileHistory(ctx context.Context, in *FileName, opts ...grpc.CallOption) (*FileHistory, error)
+	RenameFile(ctx context.Context, in *FileRename, opts ...grpc.CallOption) (*Version, error)
+	UpdateFileIf(ctx context.Context, in *FileUpdate, opts ...grpc.CallOption) (*Version, error)
 }
 
 type metaStoreClient struct {
@@ -217,6 +220,33 @@ func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Emp
 	return out, nil
 }
 
+func (c *metaStoreClient) GetFileHistory(ctx context.Context, in *FileName, opts ...grpc.CallOption) (*FileHistory, error) {
+	out := new(FileHistory)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetFileHistory", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) RenameFile(ctx context.Context, in *FileRename, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RenameFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) UpdateFileIf(ctx context.Context, in *FileUpdate, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/UpdateFileIf", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetaStoreServer is the server API for MetaStore service.
 // All implementations must embed UnimplementedMetaStoreServer
 // for forward compatibility
@@ -224,6 +254,9 @@ type MetaStoreServer interface {
 	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
 	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	GetFileHistory(context.Context, *FileName) (*FileHistory, error)
+	RenameFile(context.Context, *FileRename) (*Version, error)
+	UpdateFileIf(context.Context, *FileUpdate) (*Version, error)
 	mustEmbedUnimplementedMetaStoreServer()
 }
 
@@ -240,6 +273,15 @@ func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (
 func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
 }
+func (UnimplementedMetaStoreServer) GetFileHistory(context.Context, *FileName) (*FileHistory, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileHistory not implemented")
+}
+func (UnimplementedMetaStoreServer) RenameFile(context.Context, *FileRename) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenameFile not implemented")
+}
+func (UnimplementedMetaStoreServer) UpdateFileIf(context.Context, *FileUpdate) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateFileIf not implemented")
+}
 func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
 // UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -307,6 +349,60 @@ func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_GetFileHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileName)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetFileHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetFileHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetFileHistory(ctx, req.(*FileName))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_RenameFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileRename)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RenameFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RenameFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RenameFile(ctx, req.(*FileRename))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_UpdateFileIf_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileUpdate)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).UpdateFileIf(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/UpdateFileIf",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).UpdateFileIf(ctx, req.(*FileUpdate))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -326,6 +422,18 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetBlockStoreAddr",
 			Handler:    _MetaStore_GetBlockStoreAddr_Handler,
 		},
+		{
+			MethodName: "GetFileHistory",
+			Handler:    _MetaStore_GetFileHistory_Handler,
+		},
+		{
+			MethodName: "RenameFile",
+			Handler:    _MetaStore_RenameFile_Handler,
+		},
+		{
+			MethodName: "UpdateFileIf",
+			Handler:    _MetaStore_UpdateFileIf_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
@@ -0,0 +1,131 @@
+package surfstore
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+)
+
+/*
+	Error Related
+
+	The servers return gRPC statuses with a code telling what went wrong, and
+	a detail message when the client needs more than the code: a
+	VersionConflict for FAILED_PRECONDITION, a FileName or a BlockHash for
+	NOT_FOUND. RPCClient turns them back into the errors below, so callers
+	can use errors.Is and errors.As instead of matching messages.
+*/
+
+var ErrNotFound = errors.New("not found")
+var ErrVersionConflict = errors.New("version conflict")
+var ErrAlreadyExists = errors.New("already exists")
+var ErrInvalidArgument = errors.New("invalid argument")
+
+// VersionConflictError is returned when the server rejects the version of
+// an update, because the file was changed by another client.
+type VersionConflictError struct {
+	Filename       string
+	Version        int32         // version of the rejected update
+	CurrentVersion int32         // version on the server, 0 if the file doesn't exist
+	Current        *FileMetaData // file on the server, nil if it doesn't exist or the server didn't send it
+}
+
+func (e *VersionConflictError) Error() string {
+	if e.CurrentVersion == 0 {
+		return fmt.Sprintf("version conflict on %s: version %d rejected, the file isn't on the server", e.Filename, e.Version)
+	}
+	return fmt.Sprintf("version conflict on %s: version %d rejected, the server has version %d", e.Filename, e.Version, e.CurrentVersion)
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+// FileNotFoundError is returned when a file isn't on the MetaStore.
+type FileNotFoundError struct {
+	Filename string
+}
+
+func (e *FileNotFoundError) Error() string {
+	return fmt.Sprintf("file %s not found", e.Filename)
+}
+
+func (e *FileNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// BlockNotFoundError is returned when a block isn't on the BlockStore.
+type BlockNotFoundError struct {
+	Hash string
+}
+
+func (e *BlockNotFoundError) Error() string {
+	return fmt.Sprintf("block %s not found", e.Hash)
+}
+
+func (e *BlockNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// statusError returns a status with code, a message made of what and val,
+// and detail if it isn't nil.
+func statusError(code codes.Code, what, val string, detail protoiface.MessageV1) error {
+	st := status.New(code, fmt.Sprintf("%s %q", what, val))
+	if detail != nil {
+		if with_detail, err := st.WithDetails(detail); err == nil {
+			st = with_detail
+		}
+	}
+	return st.Err()
+}
+
+func versionConflictError(filename string, version int32, current *FileMetaData) error {
+	return statusError(codes.FailedPrecondition, "Invalid version", fmt.Sprint(version),
+		&VersionConflict{Filename: filename, Version: version, CurrentVersion: current.GetVersion(), Current: current})
+}
+
+func fileNotFoundError(filename string) error {
+	return statusError(codes.NotFound, "Unknown file", filename, &FileName{Filename: filename})
+}
+
+func blockNotFoundError(hash string) error {
+	return statusError(codes.NotFound, "Unknown block", hash, &BlockHash{Hash: hash})
+}
+
+// fromStatus turns the status returned by a server into the errors above.
+// Errors that don't come from a server, or whose code has no matching
+// error (a timeout, an unreachable server), are returned as they are.
+func fromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *VersionConflict:
+			return &VersionConflictError{Filename: detail.Filename, Version: detail.Version, CurrentVersion: detail.CurrentVersion, Current: detail.Current}
+		case *FileName:
+			if st.Code() == codes.NotFound {
+				return &FileNotFoundError{Filename: detail.Filename}
+			}
+		case *BlockHash:
+			if st.Code() == codes.NotFound {
+				return &BlockNotFoundError{Hash: detail.Hash}
+			}
+		}
+	}
+	switch st.Code() {
+	case codes.NotFound:
+		return fmt.Errorf("%w: %s", ErrNotFound, st.Message())
+	case codes.FailedPrecondition:
+		return fmt.Errorf("%w: %s", ErrVersionConflict, st.Message())
+	case codes.AlreadyExists:
+		return fmt.Errorf("%w: %s", ErrAlreadyExists, st.Message())
+	case codes.InvalidArgument:
+		return fmt.Errorf("%w: %s", ErrInvalidArgument, st.Message())
+	}
+	return err
+}
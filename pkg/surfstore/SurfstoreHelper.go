@@ -1,14 +1,14 @@
 package surfstore
 
 import (
-	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -25,106 +25,551 @@ func GetBlockHashString(blockData []byte) string {
 	return hex.EncodeToString(blockHash)
 }
 
+/* Tombstone Related */
+
+// NewTombstone returns the metadata of a deleted file.
+func NewTombstone(filename string, version int32) *FileMetaData {
+	return &FileMetaData{Filename: filename, Version: version, BlockHashList: []string{TOMBSTONE_HASH}, Deleted: true}
+}
+
+// IsDeleted reports whether fileMetaData describes a deleted file, either
+// flagged or sent by an older client with only the "0" hash list.
+func IsDeleted(fileMetaData *FileMetaData) bool {
+	if fileMetaData.Deleted {
+		return true
+	}
+	return len(fileMetaData.BlockHashList) == 1 && fileMetaData.BlockHashList[0] == TOMBSTONE_HASH
+}
+
+// NormalizeTombstone sets both encodings of a deletion on a deleted file,
+// and drops its content fields.
+func NormalizeTombstone(fileMetaData *FileMetaData) {
+	if !IsDeleted(fileMetaData) {
+		return
+	}
+	fileMetaData.Deleted = true
+	fileMetaData.BlockHashList = []string{TOMBSTONE_HASH}
+	fileMetaData.Size = 0
+	fileMetaData.ContentHash = ""
+}
+
 /* File Path Related */
 func ConcatPath(baseDir, fileDir string) string {
 	return baseDir + "/" + fileDir
 }
 
+// IsTempFile reports whether filename is a temporary file left by an
+// in-progress (or interrupted) atomic write.
+func IsTempFile(filename string) bool {
+	return strings.HasPrefix(filename, TMP_FILE_PREFIX)
+}
+
+/*
+	Atomic File Writing Related
+*/
+
+// AtomicFile is a temporary file created next to its target path. Data is
+// written to the temporary file and only replaces the target on Commit, so a
+// crash or a full disk never leaves a truncated target behind.
+type AtomicFile struct {
+	*os.File
+	targetPath string
+}
+
+// CreateAtomicFile creates a temporary file in the same directory as
+// targetPath, which will replace targetPath when committed.
+func CreateAtomicFile(targetPath string) (*AtomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(targetPath), TMP_FILE_PREFIX+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicFile{File: f, targetPath: targetPath}, nil
+}
+
+// OpenAtomicFile reopens the temporary file of an interrupted atomic write
+// to targetPath, keeping its first size bytes and appending after them.
+func OpenAtomicFile(tempPath string, targetPath string, size int64) (*AtomicFile, error) {
+	f, err := os.OpenFile(tempPath, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &AtomicFile{File: f, targetPath: targetPath}, nil
+}
+
+// Commit flushes the temporary file to stable storage and renames it over
+// the target path. The temporary file is removed if any step fails.
+func (af *AtomicFile) Commit(perm os.FileMode) error {
+	if err := af.Chmod(perm); err != nil {
+		af.Abort()
+		return err
+	}
+	if err := af.Sync(); err != nil {
+		af.Abort()
+		return err
+	}
+	if err := af.Close(); err != nil {
+		os.Remove(af.Name())
+		return err
+	}
+	if err := os.Rename(af.Name(), af.targetPath); err != nil {
+		os.Remove(af.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(af.targetPath))
+}
+
+// Abort discards the temporary file, leaving the target path untouched.
+func (af *AtomicFile) Abort() error {
+	af.Close()
+	return os.Remove(af.Name())
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it over path.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	af, err := CreateAtomicFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := af.Write(data); err != nil {
+		af.Abort()
+		return err
+	}
+	return af.Commit(perm)
+}
+
+// IsInsideDir reports whether path is dir or somewhere below it, once both
+// are made absolute. Symlinks are not resolved.
+func IsInsideDir(path string, dir string) (bool, error) {
+	abs_path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	abs_dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(abs_dir, abs_path)
+	if err != nil {
+		return false, nil
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))), nil
+}
+
+// syncDir fsyncs a directory so that a rename inside it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 /*
 	Reading and Writing Local Metadata File Related
+
+	The local metadata file looks like:
+
+		# surfstore index v2
+		<filename>,<version>,<hash> <hash> ...
+		...
+		# sha256 <hex digest of every byte above this line>
+
+	Fields are percent-encoded (see escapeMetaField), so a filename may
+	contain any character. Entries may carry extra key=value fields after
+	the hash list; readers ignore keys they don't know. A file without the
+	header is read as the legacy format and rewritten in the current format
+	on the next WriteMetaFile.
+
+	The commits made since the file was written are appended to index.log,
+	each one being the new entries followed by a "# sha256" line of their
+	digest, and folded into the file when the index is closed.
 */
 
+// MetaFileError is returned when the local metadata file can't be trusted:
+// a line is malformed, or the checksum doesn't match the content.
+type MetaFileError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *MetaFileError) Error() string {
+	return fmt.Sprintf("corrupted metadata file %s: %s", e.Path, strings.Join(e.Problems, "; "))
+}
+
+// escapeMetaField percent-encodes the characters that are delimiters in the
+// metadata file (and '%' itself), plus control characters such as newlines.
+func escapeMetaField(field string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c == '%' || c == ',' || c == ' ' || c == '=' || c < 0x20 || c == 0x7f {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		} else {
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+func unescapeMetaField(field string) (string, error) {
+	return url.PathUnescape(field)
+}
+
+// isValidBlockHash reports whether hash looks like a block hash (or the
+// "0" tombstone of a deleted file).
+func isValidBlockHash(hash string) bool {
+	if hash == TOMBSTONE_HASH {
+		return true
+	}
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func parseBlockHashList(hashListString string) ([]string, error) {
+	blockHashList := make([]string, 0)
+	for _, hash := range strings.Split(hashListString, HASH_DELIMITER) {
+		if hash == "" {
+			continue
+		}
+		if !isValidBlockHash(hash) {
+			return nil, fmt.Errorf("invalid block hash %q", hash)
+		}
+		blockHashList = append(blockHashList, hash)
+	}
+	return blockHashList, nil
+}
+
 // NewFileMetaDataFromConfig returns a FileMetaData struct
 // associated with one line in the local metadata file.
-func NewFileMetaDataFromConfig(configString string) *FileMetaData {
+func NewFileMetaDataFromConfig(configString string) (*FileMetaData, error) {
+	fileMetaData, _, err := parseIndexEntry(configString)
+	return fileMetaData, err
+}
+
+// parseIndexEntry parses one line of the local metadata file, including the
+// stat data recorded for the file if there is any.
+func parseIndexEntry(configString string) (*FileMetaData, *FileStat, error) {
 	configItems := strings.Split(configString, CONFIG_DELIMITER)
+	if len(configItems) <= HASH_LIST_INDEX {
+		return nil, nil, fmt.Errorf("expected at least %d fields, got %d", HASH_LIST_INDEX+1, len(configItems))
+	}
+
+	filename, err := unescapeMetaField(configItems[FILENAME_INDEX])
+	if err != nil || filename == "" {
+		return nil, nil, fmt.Errorf("invalid filename %q", configItems[FILENAME_INDEX])
+	}
+	version, err := strconv.ParseInt(configItems[VERSION_INDEX], 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid version %q", configItems[VERSION_INDEX])
+	}
+	blockHashList, err := parseBlockHashList(configItems[HASH_LIST_INDEX])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	extraFields := make(map[string]string)
+	for _, extraItem := range configItems[HASH_LIST_INDEX+1:] {
+		kv := strings.SplitN(extraItem, "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, fmt.Errorf("invalid field %q", extraItem)
+		}
+		extraFields[kv[0]] = kv[1]
+	}
 
-	filename := configItems[FILENAME_INDEX]
-	version, _ := strconv.Atoi(configItems[VERSION_INDEX])
-	blockHashList := strings.Split(configItems[HASH_LIST_INDEX], HASH_DELIMITER)
+	var fileStat *FileStat
+	if sizeString, ok := extraFields[STAT_SIZE_KEY]; ok {
+		fileStat = &FileStat{}
+		if fileStat.Size, err = strconv.ParseInt(sizeString, 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("invalid size %q", sizeString)
+		}
+		if fileStat.ModTime, err = strconv.ParseInt(extraFields[STAT_MTIME_KEY], 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("invalid mtime %q", extraFields[STAT_MTIME_KEY])
+		}
+		if inodeString, ok := extraFields[STAT_INODE_KEY]; ok {
+			if fileStat.Inode, err = strconv.ParseUint(inodeString, 10, 64); err != nil {
+				return nil, nil, fmt.Errorf("invalid inode %q", inodeString)
+			}
+		}
+	}
 
-	return &FileMetaData{
+	fileMetaData := &FileMetaData{
 		Filename:      filename,
 		Version:       int32(version),
-		BlockHashList: blockHashList[:len(blockHashList)-1],
+		BlockHashList: blockHashList,
+	}
+	if modeString, ok := extraFields[META_MODE_KEY]; ok {
+		mode, err := strconv.ParseUint(modeString, 8, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid mode %q", modeString)
+		}
+		fileMetaData.Mode = uint32(mode)
 	}
+	if modTimeString, ok := extraFields[META_MTIME_KEY]; ok {
+		if fileMetaData.ModTime, err = strconv.ParseInt(modTimeString, 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("invalid modtime %q", modTimeString)
+		}
+	}
+	if typeString, ok := extraFields[META_TYPE_KEY]; ok {
+		if typeString != META_TYPE_SYMLINK {
+			return nil, nil, fmt.Errorf("invalid type %q", typeString)
+		}
+		fileMetaData.Type = FileType_SYMLINK
+		if fileMetaData.LinkTarget, err = unescapeMetaField(extraFields[META_TARGET_KEY]); err != nil || fileMetaData.LinkTarget == "" {
+			return nil, nil, fmt.Errorf("invalid target %q", extraFields[META_TARGET_KEY])
+		}
+	}
+	if contentHash, ok := extraFields[META_CONTENT_HASH_KEY]; ok {
+		if contentHash == TOMBSTONE_HASH || !isValidBlockHash(contentHash) {
+			return nil, nil, fmt.Errorf("invalid content hash %q", contentHash)
+		}
+		fileMetaData.ContentHash = contentHash
+	}
+	NormalizeTombstone(fileMetaData)
+	return fileMetaData, fileStat, nil
+}
+
+// parseLegacyIndexEntry parses one line of the legacy metadata
+// file, "<filename>,<version>,<hash> <hash> ... ". Legacy filenames were not
+// escaped, so everything before the last two commas is the filename.
+func parseLegacyIndexEntry(configString string) (*FileMetaData, *FileStat, error) {
+	configItems := strings.Split(configString, CONFIG_DELIMITER)
+	if len(configItems) < 3 {
+		return nil, nil, fmt.Errorf("expected 3 fields, got %d", len(configItems))
+	}
+
+	filename := strings.Join(configItems[:len(configItems)-2], CONFIG_DELIMITER)
+	if filename == "" {
+		return nil, nil, fmt.Errorf("empty filename")
+	}
+	version, err := strconv.ParseInt(configItems[len(configItems)-2], 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid version %q", configItems[len(configItems)-2])
+	}
+	blockHashList, err := parseBlockHashList(configItems[len(configItems)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileMetaData := &FileMetaData{
+		Filename:      filename,
+		Version:       int32(version),
+		BlockHashList: blockHashList,
+	}
+	NormalizeTombstone(fileMetaData)
+	return fileMetaData, nil, nil
 }
 
 // LoadMetaFromMetaFiles loads the local metadata file into a file meta map.
 // The key is the file's name and the value is the file's metadata.
 // You can use this function to load the index.txt file in this project.
+//
+// Both the current and the legacy format are accepted. If the file is
+// corrupted, the entries that could be parsed are returned together with a
+// *MetaFileError listing the problems. The commits logged since the file was
+// last written are included.
 func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData, e error) {
 	metaFilePath, _ := filepath.Abs(ConcatPath(baseDir, DEFAULT_META_FILENAME))
+	fileMetaMap, _, _, e = loadTextIndex(metaFilePath)
+	return fileMetaMap, e
+}
 
+// loadMetaFile loads a local metadata file together with the stat data
+// recorded for each file. A missing file is an empty index.
+func loadMetaFile(metaFilePath string) (fileMetaMap map[string]*FileMetaData, fileStatMap map[string]*FileStat, e error) {
 	fileMetaMap = make(map[string]*FileMetaData)
+	fileStatMap = make(map[string]*FileStat)
 
 	metaFileStats, e := os.Stat(metaFilePath)
 	if e != nil || metaFileStats.IsDir() {
-		return fileMetaMap, nil
+		return fileMetaMap, fileStatMap, nil
 	}
-	metaFD, e := os.Open(metaFilePath)
+	content, e := os.ReadFile(metaFilePath)
 	if e != nil {
-		log.Fatal("Error When Opening Meta")
+		return fileMetaMap, fileStatMap, e
 	}
-	defer metaFD.Close()
 
-	leftOverContent := ""
-	metaReader := bufio.NewReader(metaFD)
-	for {
-		lineContent, isPrefix, e := metaReader.ReadLine()
-		if e != nil && e != io.EOF {
-			log.Fatal("Error During Reading Meta")
-		}
+	metaFileErr := &MetaFileError{Path: metaFilePath}
+	lines := strings.Split(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
 
-		leftOverContent += string(lineContent)
-		if isPrefix {
-			continue
+	parseLine, firstEntry := parseLegacyIndexEntry, 0
+	if len(lines) > 0 && strings.HasPrefix(lines[0], META_HEADER_PREFIX) {
+		formatVersion, err := strconv.Atoi(strings.TrimPrefix(lines[0], META_HEADER_PREFIX))
+		if err != nil || formatVersion < 2 || formatVersion > META_FORMAT_VERSION {
+			metaFileErr.Problems = append(metaFileErr.Problems, fmt.Sprintf("unsupported format %q", lines[0]))
+			return fileMetaMap, fileStatMap, metaFileErr
 		}
 
-		if len(leftOverContent) == 0 {
-			break
+		// the last line is the checksum of everything before it
+		last := len(lines) - 1
+		if last < 1 || !strings.HasPrefix(lines[last], META_CHECKSUM_PREFIX) {
+			metaFileErr.Problems = append(metaFileErr.Problems, "missing checksum, the file is truncated")
+		} else {
+			checksumOffset := strings.LastIndex(string(content), lines[last])
+			if GetBlockHashString(content[:checksumOffset]) != strings.TrimPrefix(lines[last], META_CHECKSUM_PREFIX) {
+				metaFileErr.Problems = append(metaFileErr.Problems, "checksum mismatch")
+			}
+			lines = lines[:last]
 		}
 
-		currFileMeta := NewFileMetaDataFromConfig(leftOverContent)
+		parseLine, firstEntry = parseIndexEntry, 1
+	}
 
-		leftOverContent = ""
+	for i := firstEntry; i < len(lines); i++ {
+		if lines[i] == "" {
+			continue
+		}
+		currFileMeta, currFileStat, err := parseLine(lines[i])
+		if err != nil {
+			metaFileErr.Problems = append(metaFileErr.Problems, fmt.Sprintf("line %d: %v", i+1, err))
+			continue
+		}
 		fileMetaMap[currFileMeta.Filename] = currFileMeta
+		if currFileStat != nil {
+			fileStatMap[currFileMeta.Filename] = currFileStat
+		}
+	}
+
+	if len(metaFileErr.Problems) > 0 {
+		return fileMetaMap, fileStatMap, metaFileErr
+	}
+	return fileMetaMap, fileStatMap, nil
+}
+
+// metaLogPath returns the path of the commit log of the text index at
+// metaFilePath, see TextLocalIndex.
+func metaLogPath(metaFilePath string) string {
+	return filepath.Join(filepath.Dir(metaFilePath), DEFAULT_META_LOG_FILENAME)
+}
+
+// loadTextIndex loads a local metadata file and replays its commit log on
+// top of it. torn is true if the log ends with an incomplete commit (the
+// client crashed while writing it), which is ignored.
+func loadTextIndex(metaFilePath string) (fileMetaMap map[string]*FileMetaData, fileStatMap map[string]*FileStat, torn bool, e error) {
+	fileMetaMap, fileStatMap, e = loadMetaFile(metaFilePath)
+	if e != nil {
+		return fileMetaMap, fileStatMap, false, e
+	}
+	torn, e = replayMetaLog(metaLogPath(metaFilePath), fileMetaMap, fileStatMap)
+	return fileMetaMap, fileStatMap, torn, e
+}
+
+// replayMetaLog applies the commits of a commit log to the maps. Every
+// commit is index entries followed by the checksum of those entries; the
+// replay stops at the first commit whose checksum is missing or doesn't
+// match. A missing log has no commits.
+func replayMetaLog(logFilePath string, fileMetaMap map[string]*FileMetaData, fileStatMap map[string]*FileStat) (torn bool, e error) {
+	content, e := os.ReadFile(logFilePath)
+	if os.IsNotExist(e) {
+		return false, nil
+	} else if e != nil {
+		return false, e
 	}
 
-	return fileMetaMap, nil
+	pending := make([]string, 0)
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, META_CHECKSUM_PREFIX) {
+			pending = append(pending, line)
+			continue
+		}
+		if GetBlockHashString([]byte(strings.Join(pending, ""))) != strings.TrimSpace(strings.TrimPrefix(line, META_CHECKSUM_PREFIX)) {
+			return true, nil
+		}
+		for _, entry := range pending {
+			currFileMeta, currFileStat, err := parseIndexEntry(strings.TrimSuffix(entry, "\n"))
+			if err != nil {
+				return false, &MetaFileError{Path: logFilePath, Problems: []string{err.Error()}}
+			}
+			fileMetaMap[currFileMeta.Filename] = currFileMeta
+			if currFileStat != nil {
+				fileStatMap[currFileMeta.Filename] = currFileStat
+			} else {
+				delete(fileStatMap, currFileMeta.Filename)
+			}
+		}
+		pending = pending[:0]
+	}
+	return len(pending) > 0, nil
 }
 
 // FileMetaDataToString converts a FileMetaData struct
 // to a string for writing back to local metadata file
 func FileMetaDataToString(fm *FileMetaData) (result string) {
-	result += fm.Filename + ","
-	result += strconv.Itoa(int(fm.Version)) + ","
+	return indexEntryToString(fm, nil)
+}
 
-	for _, blockHash := range fm.BlockHashList {
-		result += blockHash + " "
+// indexEntryToString is FileMetaDataToString with the file's stat data
+// appended as extra fields when it is known. The file attributes of fm are
+// extra fields too.
+func indexEntryToString(fm *FileMetaData, fileStat *FileStat) (result string) {
+	result += escapeMetaField(fm.Filename) + CONFIG_DELIMITER
+	result += strconv.Itoa(int(fm.Version)) + CONFIG_DELIMITER
+	result += strings.Join(fm.BlockHashList, HASH_DELIMITER)
+
+	if fm.Mode != 0 {
+		result += CONFIG_DELIMITER + META_MODE_KEY + "=" + strconv.FormatUint(uint64(fm.Mode), 8)
+	}
+	if fm.ModTime != 0 {
+		result += CONFIG_DELIMITER + META_MTIME_KEY + "=" + strconv.FormatInt(fm.ModTime, 10)
+	}
+	if fm.Type == FileType_SYMLINK {
+		result += CONFIG_DELIMITER + META_TYPE_KEY + "=" + META_TYPE_SYMLINK
+		result += CONFIG_DELIMITER + META_TARGET_KEY + "=" + escapeMetaField(fm.LinkTarget)
+	}
+	if fm.ContentHash != "" {
+		result += CONFIG_DELIMITER + META_CONTENT_HASH_KEY + "=" + fm.ContentHash
+	}
+	if fileStat != nil {
+		result += CONFIG_DELIMITER + STAT_SIZE_KEY + "=" + strconv.FormatInt(fileStat.Size, 10)
+		result += CONFIG_DELIMITER + STAT_MTIME_KEY + "=" + strconv.FormatInt(fileStat.ModTime, 10)
+		result += CONFIG_DELIMITER + STAT_INODE_KEY + "=" + strconv.FormatUint(fileStat.Inode, 10)
 	}
 
 	result += "\n"
 	return
 }
 
-// WriteMetaFile writes the file meta map back to local metadata file
+// WriteMetaFile writes the file meta map back to local metadata file.
+// The file is replaced atomically, so readers see either the old or the new
+// index, never a partially written one.
 func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
-	outputMetaPath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
+	return writeMetaFile(ConcatPath(baseDir, DEFAULT_META_FILENAME), fileMetas, nil)
+}
 
-	outFD, err := os.Create(outputMetaPath)
-	if err != nil {
-		log.Fatal("Error During Meta Write Back")
+// writeMetaFile is WriteMetaFile with the stat data of each file, which may
+// be nil or miss some files.
+func writeMetaFile(outputMetaPath string, fileMetas map[string]*FileMetaData, fileStats map[string]*FileStat) error {
+	filenames := make([]string, 0, len(fileMetas))
+	for filename := range fileMetas {
+		filenames = append(filenames, filename)
 	}
+	sort.Strings(filenames)
 
-	for _, fileMeta := range fileMetas {
-		_, err := outFD.WriteString(FileMetaDataToString(fileMeta))
-		if err != nil {
-			log.Fatal("Error During Meta Write Back")
-		}
+	var content strings.Builder
+	content.WriteString(META_HEADER_PREFIX + strconv.Itoa(META_FORMAT_VERSION) + "\n")
+	for _, filename := range filenames {
+		content.WriteString(indexEntryToString(fileMetas[filename], fileStats[filename]))
 	}
+	content.WriteString(META_CHECKSUM_PREFIX + GetBlockHashString([]byte(content.String())) + "\n")
 
-	return nil
+	return WriteFileAtomic(outputMetaPath, []byte(content.String()), 0644)
 }
 
 /*
@@ -0,0 +1,259 @@
+package surfstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var hashA = GetBlockHashString([]byte("a"))
+var hashB = GetBlockHashString([]byte("b"))
+
+func TestEscapeMetaField(t *testing.T) {
+	tests := []struct {
+		field   string
+		escaped string
+	}{
+		{"plain.txt", "plain.txt"},
+		{"", ""},
+		{"a,b", "a%2Cb"},
+		{"with space", "with%20space"},
+		{"key=value", "key%3Dvalue"},
+		{"100%", "100%25"},
+		{"line\nbreak", "line%0Abreak"},
+		{"tab\there", "tab%09here"},
+		{"del\x7f", "del%7F"},
+		{"café ☕", "café%20☕"},
+		{"%2C", "%252C"},
+	}
+	for _, test := range tests {
+		t.Run(test.escaped, func(t *testing.T) {
+			escaped := escapeMetaField(test.field)
+			if escaped != test.escaped {
+				t.Errorf("escapeMetaField(%q) = %q, want %q", test.field, escaped, test.escaped)
+			}
+			if strings.ContainsAny(escaped, CONFIG_DELIMITER+" =\n") {
+				t.Errorf("escapeMetaField(%q) = %q contains a delimiter", test.field, escaped)
+			}
+			unescaped, err := unescapeMetaField(escaped)
+			if err != nil || unescaped != test.field {
+				t.Errorf("unescapeMetaField(%q) = %q, %v, want %q", escaped, unescaped, err, test.field)
+			}
+		})
+	}
+}
+
+func TestParseIndexEntry(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+		meta  *FileMetaData // nil if the entry is invalid
+		stat  *FileStat
+	}{
+		{"file", "a.txt,3," + hashA + " " + hashB,
+			&FileMetaData{Filename: "a.txt", Version: 3, BlockHashList: []string{hashA, hashB}}, nil},
+		{"empty file", "empty,1,",
+			&FileMetaData{Filename: "empty", Version: 1, BlockHashList: []string{}}, nil},
+		{"escaped filename", "a%2Cb%20c,1," + hashA,
+			&FileMetaData{Filename: "a,b c", Version: 1, BlockHashList: []string{hashA}}, nil},
+		{"deleted file", "gone,2,0",
+			NewTombstone("gone", 2), nil},
+		{"stat data", "a,1," + hashA + ",size=1,mtime=42,inode=7",
+			&FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}}, &FileStat{Size: 1, ModTime: 42, Inode: 7}},
+		{"attributes", "a,1," + hashA + ",mode=755,modtime=42,sha256=" + hashB,
+			&FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}, Mode: 0755, ModTime: 42, ContentHash: hashB}, nil},
+		{"symlink", "l,1," + hashA + ",type=symlink,target=..%2Fx%20y",
+			&FileMetaData{Filename: "l", Version: 1, BlockHashList: []string{hashA}, Type: FileType_SYMLINK, LinkTarget: "../x y"}, nil},
+		{"unknown key", "a,1," + hashA + ",color=blue",
+			&FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}}, nil},
+		{"missing hash list", "a,1", nil, nil},
+		{"empty filename", ",1," + hashA, nil, nil},
+		{"bad escape", "a%zz,1," + hashA, nil, nil},
+		{"bad version", "a,one," + hashA, nil, nil},
+		{"bad hash", "a,1,abc", nil, nil},
+		{"field without value", "a,1," + hashA + ",size", nil, nil},
+		{"bad size", "a,1," + hashA + ",size=big,mtime=1", nil, nil},
+		{"bad mode", "a,1," + hashA + ",mode=9", nil, nil},
+		{"bad type", "a,1," + hashA + ",type=fifo", nil, nil},
+		{"symlink without target", "l,1," + hashA + ",type=symlink", nil, nil},
+		{"tombstone content hash", "a,1," + hashA + ",sha256=0", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meta, stat, err := parseIndexEntry(test.entry)
+			if test.meta == nil {
+				if err == nil {
+					t.Fatalf("parseIndexEntry(%q) = %v, want an error", test.entry, meta)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIndexEntry(%q): %v", test.entry, err)
+			}
+			if !proto.Equal(meta, test.meta) {
+				t.Errorf("parseIndexEntry(%q) = %v, want %v", test.entry, meta, test.meta)
+			}
+			if (stat == nil) != (test.stat == nil) || (stat != nil && *stat != *test.stat) {
+				t.Errorf("parseIndexEntry(%q) stat = %+v, want %+v", test.entry, stat, test.stat)
+			}
+
+			// and back
+			entry := indexEntryToString(meta, stat)
+			reparsed, restat, err := parseIndexEntry(strings.TrimSuffix(entry, "\n"))
+			if err != nil || !proto.Equal(reparsed, meta) || (restat == nil) != (stat == nil) {
+				t.Errorf("%q doesn't parse back: %v, %v", entry, reparsed, err)
+			}
+		})
+	}
+}
+
+func TestMetaFileRoundTrip(t *testing.T) {
+	fileMetas := map[string]*FileMetaData{
+		"a":       {Filename: "a", Version: 1, BlockHashList: []string{hashA}, Mode: 0644, ModTime: 42, ContentHash: hashA},
+		"b, c\nd": {Filename: "b, c\nd", Version: 2, BlockHashList: []string{hashA, hashB}},
+		"gone":    NewTombstone("gone", 3),
+	}
+	fileStats := map[string]*FileStat{
+		"a": {Size: 1, ModTime: 42, Inode: 7},
+	}
+	metaFilePath := filepath.Join(t.TempDir(), DEFAULT_META_FILENAME)
+	if err := writeMetaFile(metaFilePath, fileMetas, fileStats); err != nil {
+		t.Fatal(err)
+	}
+
+	loadedMetas, loadedStats, err := loadMetaFile(metaFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loadedMetas) != len(fileMetas) {
+		t.Errorf("loaded %d files, want %d", len(loadedMetas), len(fileMetas))
+	}
+	for filename, fileMeta := range fileMetas {
+		if !proto.Equal(loadedMetas[filename], fileMeta) {
+			t.Errorf("loaded %v, want %v", loadedMetas[filename], fileMeta)
+		}
+	}
+	if len(loadedStats) != 1 || *loadedStats["a"] != *fileStats["a"] {
+		t.Errorf("loaded stats %v, want %v", loadedStats, fileStats)
+	}
+}
+
+func TestLoadMetaFile(t *testing.T) {
+	written := func(t *testing.T) string {
+		path := filepath.Join(t.TempDir(), DEFAULT_META_FILENAME)
+		fileMetas := map[string]*FileMetaData{
+			"a": {Filename: "a", Version: 1, BlockHashList: []string{hashA}},
+			"b": {Filename: "b", Version: 2, BlockHashList: []string{hashB}},
+		}
+		if err := writeMetaFile(path, fileMetas, nil); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(path)
+		return string(content)
+	}
+	tests := []struct {
+		name      string
+		content   func(t *testing.T) string
+		files     map[string]int32 // version of each file loaded
+		corrupted bool
+	}{
+		{"current format", written, map[string]int32{"a": 1, "b": 2}, false},
+		{"legacy format", func(t *testing.T) string {
+			return "a,1," + hashA + "\nwith,comma,2," + hashB + "\ngone,3,0\n"
+		}, map[string]int32{"a": 1, "with,comma": 2, "gone": 3}, false},
+		{"empty", func(t *testing.T) string { return "" }, map[string]int32{}, false},
+		{"checksum mismatch", func(t *testing.T) string {
+			return strings.Replace(written(t), "b,2,", "b,3,", 1)
+		}, map[string]int32{"a": 1, "b": 3}, true},
+		{"truncated", func(t *testing.T) string {
+			content := written(t)
+			return content[:strings.LastIndex(content, META_CHECKSUM_PREFIX)]
+		}, map[string]int32{"a": 1, "b": 2}, true},
+		{"malformed line", func(t *testing.T) string {
+			return "a,1," + hashA + "\nb,x," + hashB + "\n"
+		}, map[string]int32{"a": 1}, true},
+		{"unsupported format", func(t *testing.T) string {
+			return META_HEADER_PREFIX + "99\n"
+		}, map[string]int32{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), DEFAULT_META_FILENAME)
+			if err := os.WriteFile(path, []byte(test.content(t)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			fileMetas, _, err := loadMetaFile(path)
+			var metaFileErr *MetaFileError
+			if corrupted := errors.As(err, &metaFileErr); corrupted != test.corrupted {
+				t.Errorf("got error %v, corrupted: %v", err, test.corrupted)
+			}
+			if len(fileMetas) != len(test.files) {
+				t.Errorf("loaded %d files, want %d", len(fileMetas), len(test.files))
+			}
+			for filename, version := range test.files {
+				if fileMetas[filename].GetVersion() != version {
+					t.Errorf("loaded %s %v, want version %d", filename, fileMetas[filename], version)
+				}
+			}
+		})
+	}
+}
+
+func TestLegacyMetaFileMigration(t *testing.T) {
+	baseDir := t.TempDir()
+	legacy := "a,1," + hashA + "\nb,2,0\n"
+	if err := os.WriteFile(filepath.Join(baseDir, DEFAULT_META_FILENAME), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileMetas, err := LoadMetaFromMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetaFile(fileMetas, baseDir); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(filepath.Join(baseDir, DEFAULT_META_FILENAME))
+	if !strings.HasPrefix(string(content), META_HEADER_PREFIX) {
+		t.Errorf("migrated file isn't in the current format:\n%s", content)
+	}
+	migrated, err := LoadMetaFromMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, fileMeta := range fileMetas {
+		if !proto.Equal(migrated[filename], fileMeta) {
+			t.Errorf("migrated %v, want %v", migrated[filename], fileMeta)
+		}
+	}
+	if !IsDeleted(migrated["b"]) || !migrated["b"].Deleted {
+		t.Errorf("migrated %v, want a flagged tombstone", migrated["b"])
+	}
+}
+
+func TestIsInsideDir(t *testing.T) {
+	tests := []struct {
+		path   string
+		dir    string
+		inside bool
+	}{
+		{"base", "base", true},
+		{"base/.cache", "base", true},
+		{"./base/a/../b", "base", true},
+		{"base2", "base", false},
+		{"../base", "base", false},
+		{"other/.cache", "base", false},
+		{"/tmp/cache", "base", false},
+		{"base/..", "base", false},
+	}
+	for _, test := range tests {
+		inside, err := IsInsideDir(test.path, test.dir)
+		if err != nil || inside != test.inside {
+			t.Errorf("IsInsideDir(%q, %q) = %v, %v, want %v", test.path, test.dir, inside, err, test.inside)
+		}
+	}
+}
@@ -15,6 +15,15 @@ type MetaStoreInterface interface {
 
 	// Get the the BlockStore address
 	GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error)
+
+	// Retrieves every version of a file, oldest first
+	GetFileHistory(ctx context.Context, fileName *FileName) (*FileHistory, error)
+
+	// Delete a file and create another one with its content, atomically
+	RenameFile(ctx context.Context, fileRename *FileRename) (*Version, error)
+
+	// Update a file's fileinfo entry if its version is the expected one
+	UpdateFileIf(ctx context.Context, fileUpdate *FileUpdate) (*Version, error)
 }
 
 type BlockStoreInterface interface {
@@ -35,6 +44,9 @@ type ClientInterface interface {
 	GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error
 	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
 	GetBlockStoreAddr(blockStoreAddr *string) error
+	GetFileHistory(filename string, history *[]*FileMetaData) error
+	RenameFile(from *FileMetaData, to *FileMetaData, latestVersion *int32) error
+	UpdateFileIf(fileMetaData *FileMetaData, expectedVersion int32, latestVersion *int32) error
 
 	// BlockStore
 	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
@@ -2,7 +2,6 @@ package surfstore
 
 import (
 	context "context"
-	"fmt"
 	"time"
 
 	grpc "google.golang.org/grpc"
@@ -13,6 +12,16 @@ type RPCClient struct {
 	MetaStoreAddr string
 	BaseDir       string
 	BlockSize     int
+	IndexType     string // local index backend, INDEX_TYPE_TEXT (default) or INDEX_TYPE_BOLT
+	FullRescan    bool   // rehash every file, even if its stat data is unchanged
+	Concurrency   int    // number of files hashed or transferred, and of blocks transferred, at the same time
+	SymlinkPolicy string // SYMLINK_POLICY_SKIP (default), SYMLINK_POLICY_KEEP or SYMLINK_POLICY_FOLLOW
+	CasePolicy    string // CASE_POLICY_SKIP (default), CASE_POLICY_RENAME or CASE_POLICY_ERROR
+
+	// on-disk cache of downloaded blocks, disabled if BlockCacheDir is empty.
+	// It must be outside of BaseDir.
+	BlockCacheDir  string
+	BlockCacheSize int64 // in bytes
 }
 
 func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
@@ -29,7 +38,7 @@ func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, b
 	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash})
 	if err != nil {
 		conn.Close()
-		return err
+		return fromStatus(err)
 	}
 	block.BlockData = b.BlockData
 	block.BlockSize = b.BlockSize
@@ -52,7 +61,7 @@ func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ
 	ret_succ, err := c.PutBlock(ctx, &Block{BlockData: block.BlockData, BlockSize: block.BlockSize})
 	if err != nil {
 		conn.Close()
-		return err
+		return fromStatus(err)
 	}
 	*succ = ret_succ.Flag
 	// close the connection
@@ -72,7 +81,7 @@ func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr st
 	tmp, err := c.HasBlocks(ctx, &BlockHashes{Hashes: blockHashesIn})
 	if err != nil {
 		conn.Close()
-		return err
+		return fromStatus(err)
 	}
 	*blockHashesOut = tmp.Hashes
 	// close the connection
@@ -93,8 +102,7 @@ func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileM
 	tmp, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
 	if err != nil {
 		conn.Close()
-		fmt.Println(err)
-		return err
+		return fromStatus(err)
 	}
 	*serverFileInfoMap = (*tmp).FileInfoMap
 
@@ -116,7 +124,7 @@ func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersio
 	version, err := c.UpdateFile(ctx, fileMetaData)
 	if err != nil {
 		conn.Close()
-		return err
+		return fromStatus(err)
 	}
 	*latestVersion = (*version).Version
 
@@ -138,7 +146,7 @@ func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
 	addr, err := c.GetBlockStoreAddr(ctx, &emptypb.Empty{})
 	if err != nil {
 		conn.Close()
-		return err
+		return fromStatus(err)
 	}
 	*blockStoreAddr = addr.Addr
 
@@ -146,6 +154,72 @@ func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
 	return conn.Close()
 }
 
+func (surfClient *RPCClient) GetFileHistory(filename string, history *[]*FileMetaData) error {
+	// connect to the server
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tmp, err := c.GetFileHistory(ctx, &FileName{Filename: filename})
+	if err != nil {
+		conn.Close()
+		return fromStatus(err)
+	}
+	*history = tmp.Versions
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) RenameFile(from *FileMetaData, to *FileMetaData, latestVersion *int32) error {
+	// connect to the server
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	version, err := c.RenameFile(ctx, &FileRename{From: from, To: to})
+	if err != nil {
+		conn.Close()
+		return fromStatus(err)
+	}
+	*latestVersion = (*version).Version
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) UpdateFileIf(fileMetaData *FileMetaData, expectedVersion int32, latestVersion *int32) error {
+	// connect to the server
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	version, err := c.UpdateFileIf(ctx, &FileUpdate{File: fileMetaData, ExpectedVersion: expectedVersion})
+	if err != nil {
+		conn.Close()
+		return fromStatus(err)
+	}
+	*latestVersion = (*version).Version
+
+	// close the connection
+	return conn.Close()
+}
+
 // This line guarantees all method for RPCClient are implemented
 var _ ClientInterface = new(RPCClient)
 
@@ -156,5 +230,8 @@ func NewSurfstoreRPCClient(hostPort, baseDir string, blockSize int) RPCClient {
 		MetaStoreAddr: hostPort,
 		BaseDir:       baseDir,
 		BlockSize:     blockSize,
+		Concurrency:   DEFAULT_CONCURRENCY,
+		SymlinkPolicy: SYMLINK_POLICY_SKIP,
+		CasePolicy:    CASE_POLICY_SKIP,
 	}
 }
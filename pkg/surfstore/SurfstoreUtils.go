@@ -1,152 +1,654 @@
 package surfstore
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-// Implement the logic for a client syncing with the server here.
+// ClientSync syncs the client's base directory with the server, see Sync,
+// printing its progress on stdout. It panics if the sync can't run.
 func ClientSync(client RPCClient) {
+	if _, err := Sync(context.Background(), SyncOptions{Client: client, Output: os.Stdout}); err != nil {
+		log.Panicln("Error occured when syncing!", err)
+	}
+}
+
+// Sync syncs the base directory of opts.Client with the server. It returns
+// an error if the sync can't run, or stopped because the local index can't
+// be written or ctx is done; the files synced until then are kept. A file
+// that can't be synced doesn't stop the sync, it is reported as failed in
+// the SyncReport and retried by the next sync.
+//
+// ctx is checked between files, and between the windows of blocks of a
+// file being transferred, which is then resumed by the next sync. An RPC
+// already sent isn't cancelled, but none takes more than a second.
+func Sync(ctx context.Context, opts SyncOptions) (*SyncReport, error) {
 	// basic logic refers professor's response in https://piazza.com/class/kxwl1taq8t1ql?cid=425
+	client := opts.Client
+	output := opts.Output
+	if output == nil {
+		output = ioutil.Discard
+	}
+	report := &SyncReport{Files: make([]*FileResult, 0), Started: time.Now()}
+	var transfers *Transfers
+	defer func() {
+		if transfers != nil {
+			report.finish(transfers.Stats)
+		} else {
+			report.finish(nil)
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return report, fmt.Errorf("sync interrupted: %w", err)
+	}
+
+	// files already in sync with the server, the local index is updated after every file
+	local_index, err := OpenLocalIndex(client)
+	if err != nil {
+		return report, fmt.Errorf("open local index: %w", err)
+	}
+	defer func() {
+		// the text index folds the commits of the sync into index.txt
+		if err := local_index.Close(); err != nil {
+			log.Println("Error occured when closing the local index!", err)
+		}
+	}()
+
+	// files left out of the sync are ignored on both sides, so they are neither uploaded, downloaded nor deleted
+	sync_filter, err := LoadSyncFilter(client)
+	if err != nil {
+		return report, fmt.Errorf("load sync filter: %w", err)
+	}
+
+	// files are renamed to the normalized form of their name, which is their key
+	if err := NormalizeLocalFilenames(client, sync_filter); err != nil {
+		return report, err
+	}
+	committed_FileInfoMap, committed_FileStats, err := local_index.Load()
+	if err != nil {
+		return report, fmt.Errorf("load local index: %w", err)
+	}
+
+	// transfers left in progress by an interrupted sync are resumed
+	journal, err := OpenTransferJournal(client.BaseDir)
+	if err != nil {
+		log.Println("Error occured when opening the transfer journal, syncing without resuming!", err)
+	}
+	defer journal.Close()
+	journal.RemoveStaleTempFiles(client.BaseDir)
+	if in_progress := journal.InProgress(); len(in_progress) > 0 {
+		fmt.Fprintln(output, "Resuming interrupted sync:")
+		for _, description := range in_progress {
+			fmt.Fprintln(output, "  "+description)
+		}
+	}
 
 	// scan the base directory, and for each file, compute that file’s hash list
-	local_Filehashlists := ComputeFileHashlist(client)
+	local_Filehashlists, local_FileStats, err := ComputeFileHashlist(client, committed_FileInfoMap, committed_FileStats, journal, sync_filter)
+	if err != nil {
+		return report, err
+	}
+	// filtered after the scan, which finds the skipped symlinks
+	committed_FileInfoMap = sync_filter.FilterMetaMap(committed_FileInfoMap)
 
 	// git add, add local unadded file to local index (treating this as commit is also ok)
-	local_FileInfoMap := GitAdd(client, local_Filehashlists, client.BaseDir)
+	local_FileInfoMap, err := GitAdd(client, local_Filehashlists, local_FileStats, committed_FileInfoMap)
+	if err != nil {
+		return report, err
+	}
 
 	// get remote_FileInfoMap
 	var remote_FileInfoMap map[string]*FileMetaData
-	err := client.GetFileInfoMap(&remote_FileInfoMap)
+	err = client.GetFileInfoMap(&remote_FileInfoMap)
 	if err != nil {
-		log.Panicln("Error occured when call client.GetFileInfoMap API!", err)
+		return report, fmt.Errorf("get file info map: %w", err)
 	}
+	all_remote_FileInfoMap := remote_FileInfoMap
+	remote_FileInfoMap = sync_filter.FilterMetaMap(remote_FileInfoMap)
+	MigrateRemoteFilenames(client, remote_FileInfoMap)
 
-	// compare the local version number to the remote version number
-	// (1) download (pull)
-	for filename, remote_meta_data := range remote_FileInfoMap {
-		map_value, ok := local_FileInfoMap[filename]
-		if !ok || remote_meta_data.Version > map_value.Version {
-			Download_helper(client, filename, &local_FileInfoMap, &remote_FileInfoMap)
-		} else if remote_meta_data.Version == map_value.Version && !CompareHashlist(map_value.BlockHashList, remote_meta_data.BlockHashList) {
-			// race condition
-			// someone update the server, and I upload the local, now the local file and the remote file have the same version, but different content
-			Download_helper(client, filename, &local_FileInfoMap, &remote_FileInfoMap)
+	// files are transferred concurrently, but committed to the local index in filename order
+	file_pool := NewWorkerPool(client.Concurrency)
+
+	// blocks already on this machine are not downloaded again
+	transfers = NewTransfers(client, local_Filehashlists, journal)
+	transfers.Output = output
+
+	// compare the local version numbers to the remote version numbers
+	plan := PlanSync(local_FileInfoMap, committed_FileInfoMap, remote_FileInfoMap)
+	conflicts := make(map[string]bool)
+	for _, filename := range plan.Conflicts {
+		log.Println("Conflict, local changes are overwritten by the remote version!", filename)
+		conflicts[filename] = true
+	}
+	if isCaseInsensitiveDir(client.BaseDir) {
+		planCaseCollisions(plan, local_FileInfoMap)
+	}
+	report.ScanDuration = time.Since(report.Started)
+	if len(plan.CaseCollisions) > 0 && client.CasePolicy == CASE_POLICY_ERROR {
+		for _, collision := range plan.CaseCollisions {
+			fmt.Fprintf(output, "%s differs only in case from %s\n", collision.File.Filename, collision.CollidesWith)
 		}
+		return report, fmt.Errorf("%d remote files differ only in case from other files", len(plan.CaseCollisions))
+	}
+
+	// the sync stops at the first error writing the local index, as the
+	// files synced after it couldn't be recorded
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	transfers.Context = ctx
+	var index_err error
+	commit := func(fileMetaDatas ...*FileMetaData) error {
+		err := CommitMeta(local_index, committed_FileInfoMap, local_FileStats, fileMetaDatas...)
+		if err != nil && index_err == nil {
+			index_err = err
+			cancel()
+		}
+		return err
+	}
+	stopped := func() (*SyncReport, error) {
+		if index_err != nil {
+			return report, index_err
+		}
+		return report, fmt.Errorf("sync interrupted: %w", ctx.Err())
+	}
+	if commit(changedIndexEntries(committed_FileInfoMap, committed_FileStats, local_FileStats, plan.Unchanged)...) != nil {
+		return stopped()
+	}
+
+	// symlinks left out by the policy, on either side, the files left out
+	// by the patterns are only counted as they are left out on purpose
+	for _, filename := range sync_filter.SkippedLinks() {
+		report.add(&FileResult{Filename: filename, Action: SYNC_ACTION_SKIP, Version: all_remote_FileInfoMap[filename].GetVersion()})
+	}
+	report.Filtered = sync_filter.FilteredCount()
+
+	// remote files colliding with another one in a case-insensitive base directory
+	for _, collision := range plan.CaseCollisions {
+		if ctx.Err() != nil {
+			return stopped()
+		}
+		if client.CasePolicy == CASE_POLICY_SKIP {
+			log.Println("Case collision, not downloaded!", collision.File.Filename, collision.CollidesWith)
+			report.add(&FileResult{Filename: collision.File.Filename, Action: SYNC_ACTION_SKIP, Version: collision.File.Version})
+			continue
+		}
+		fileRename, err := RenameCaseCollision(client, collision, local_FileInfoMap, remote_FileInfoMap)
+		if err != nil {
+			log.Println("Error occured when renaming a case collision!", err)
+			report.add(&FileResult{Filename: collision.File.Filename, Action: SYNC_ACTION_RENAME_REMOTE, Version: collision.File.Version, Err: err})
+			continue
+		}
+		fmt.Fprintf(output, "Renamed %s to %s, its name differs only in case from %s\n", fileRename.From.Filename, fileRename.To.Filename, collision.CollidesWith)
+		err = commit(fileRename.From)
+		report.add(&FileResult{Filename: fileRename.To.Filename, Action: SYNC_ACTION_RENAME_REMOTE, Version: fileRename.To.Version, From: fileRename.From.Filename, Err: err})
+		plan.Downloads = append(plan.Downloads, fileRename.To)
+	}
+
+	// (0) files renamed on the server are renamed locally instead of downloaded again
+	for _, fileRename := range plan.RemoteRenames {
+		if ctx.Err() != nil {
+			return stopped()
+		}
+		result := &FileResult{Filename: fileRename.To.Filename, Action: SYNC_ACTION_RENAME_LOCAL, Version: fileRename.To.Version, From: fileRename.From.Filename}
+		report.add(result)
+		if result.Err = LocalRename_helper(client, fileRename); result.Err != nil {
+			// the index keeps the old name, the next sync will retry
+			log.Println("Error occured when renaming file!", result.Err)
+			continue
+		}
+		delete(local_FileStats, fileRename.From.Filename)
+		if info, err := os.Lstat(client.BaseDir + "/" + fileRename.To.Filename); err == nil {
+			local_FileStats[fileRename.To.Filename] = NewFileStat(info)
+		}
+		result.Err = commit(fileRename.From, fileRename.To)
+	}
+
+	// (1) download (pull), deletions first so a file isn't deleted after a
+	// download replaced it under a name differing only in case
+	deletions, downloads := make([]*FileMetaData, 0), make([]*FileMetaData, 0)
+	for _, remote_meta_data := range plan.Downloads {
+		if IsDeleted(remote_meta_data) {
+			deletions = append(deletions, remote_meta_data)
+		} else {
+			downloads = append(downloads, remote_meta_data)
+		}
+	}
+	sortMetaList(downloads)
+	for _, remote_meta_datas := range [][]*FileMetaData{deletions, downloads} {
+		remote_meta_datas := remote_meta_datas
+		file_pool.RunOrdered(len(remote_meta_datas), func(i int) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return Download_helper(client, transfers, remote_meta_datas[i])
+		}, func(i int, err error) {
+			filename := remote_meta_datas[i].Filename
+			result := &FileResult{Filename: filename, Action: downloadAction(remote_meta_datas[i]), Version: remote_meta_datas[i].Version, Err: err}
+			if conflicts[filename] {
+				result.Action = SYNC_ACTION_CONFLICT
+			}
+			report.add(result)
+			if err != nil {
+				// leave the local file and its index entry untouched, the next sync will retry
+				log.Println("Error occured when downloading file!", err)
+				return
+			}
+			if info, err := os.Lstat(client.BaseDir + "/" + filename); err == nil {
+				local_FileStats[filename] = NewFileStat(info)
+			} else {
+				delete(local_FileStats, filename)
+			}
+			result.Err = commit(remote_meta_datas[i])
+		})
+	}
+	if ctx.Err() != nil {
+		return stopped()
 	}
 
 	// (2) upload (push)
-	for filename, local_meta_data := range local_FileInfoMap {
+	upload_conflicts := make(map[*FileMetaData]*VersionConflictError)
+	file_pool.RunOrdered(len(plan.Uploads), func(i int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		local_meta_data := plan.Uploads[i]
 		// deleted or not
-		deleted_flag := false
-		if len(local_FileInfoMap[filename].BlockHashList) == 1 && local_FileInfoMap[filename].BlockHashList[0] == "0" {
-			deleted_flag = true
+		deleted_flag := IsDeleted(local_meta_data)
+		// the version the plan was made with, so a file created or changed since then isn't overwritten
+		expected_version := NO_FILE_VERSION
+		if remote_meta_data, ok := remote_FileInfoMap[local_meta_data.Filename]; ok {
+			expected_version = remote_meta_data.Version
 		}
+		return Upload_helper(client, transfers, local_meta_data, local_FileStats[local_meta_data.Filename], deleted_flag, expected_version)
+	}, func(i int, err error) {
+		var conflict_err *VersionConflictError
+		if errors.As(err, &conflict_err) && conflict_err.Current != nil {
+			// changed by another client since the sync started
+			upload_conflicts[plan.Uploads[i]] = conflict_err
+			return
+		}
+		result := &FileResult{Filename: plan.Uploads[i].Filename, Action: uploadAction(plan.Uploads[i]), Version: plan.Uploads[i].Version, Err: err}
+		report.add(result)
+		if errors.Is(err, ErrVersionConflict) {
+			// the server didn't send its version, the next sync will download it
+			log.Println("File changed on the server while uploading it!", err)
+			return
+		} else if err != nil {
+			// the file stays modified locally, the next sync will retry
+			log.Println("Error occured when uploading file!", err)
+			return
+		}
+		result.Err = commit(plan.Uploads[i])
+	})
 
-		map_value, ok := remote_FileInfoMap[filename]
-		if !ok || (local_meta_data.Version == map_value.Version+1) {
-			Upload_helper(client, filename, &local_FileInfoMap, deleted_flag)
-		} else if local_meta_data.Version > map_value.Version+1 {
-			log.Panicln("Local version is larger than 1 compared than remote version, which is imp!", err)
+	// rejected uploads are resolved with the version sent back by the server
+	for _, local_meta_data := range plan.Uploads {
+		conflict_err, ok := upload_conflicts[local_meta_data]
+		if !ok {
+			continue
+		} else if ctx.Err() != nil {
+			return stopped()
+		}
+		current := conflict_err.Current
+		resolved, err := ResolveVersionConflict(client, transfers, local_meta_data, current, local_FileInfoMap, remote_FileInfoMap)
+		if err != nil {
+			// the next sync will retry
+			log.Println("Error occured when resolving a version conflict!", err)
+		}
+		for _, fileMetaData := range resolved {
+			if info, err := os.Lstat(client.BaseDir + "/" + fileMetaData.Filename); err == nil {
+				local_FileStats[fileMetaData.Filename] = NewFileStat(info)
+			} else {
+				delete(local_FileStats, fileMetaData.Filename)
+			}
+		}
+		commit_err := commit(resolved...)
+		if err == nil {
+			err = commit_err
+		}
+		report.add(&FileResult{Filename: local_meta_data.Filename, Action: SYNC_ACTION_CONFLICT, Version: current.Version, Err: err})
+		for _, fileMetaData := range resolved {
+			if fileMetaData != current {
+				// the conflicted copy
+				report.add(&FileResult{Filename: fileMetaData.Filename, Action: SYNC_ACTION_UPLOAD, Version: fileMetaData.Version, Err: commit_err})
+			}
 		}
 	}
 
-	// update index.txt
-	err = WriteMetaFile(local_FileInfoMap, client.BaseDir)
-	if err != nil {
-		log.Fatal("Error when call WriteMetaFile api!")
+	// (3) files renamed locally are renamed on the server, their blocks are already there
+	file_pool.RunOrdered(len(plan.Renames), func(i int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return Rename_helper(client, plan.Renames[i], local_FileStats[plan.Renames[i].To.Filename])
+	}, func(i int, err error) {
+		fileRename := plan.Renames[i]
+		result := &FileResult{Filename: fileRename.To.Filename, Action: SYNC_ACTION_RENAME_REMOTE, Version: fileRename.To.Version, From: fileRename.From.Filename, Err: err}
+		report.add(result)
+		if err != nil {
+			// the next sync will retry
+			log.Println("Error occured when renaming file!", err)
+			return
+		}
+		result.Err = commit(fileRename.From, fileRename.To)
+	})
+	if ctx.Err() != nil {
+		return stopped()
+	}
+	// every file was visited, a transfer left over has nothing to resume
+	journal.AbandonUntouched()
+	return report, nil
+}
+
+// CommitMeta records that files are now in sync with the server and writes
+// them to the local index right away, so an interrupted sync resumes from
+// this point instead of seeing the files as changed or conflicting.
+// local_FileStats must describe the local copies of the committed files.
+func CommitMeta(local_index LocalIndex, committed_FileInfoMap map[string]*FileMetaData, local_FileStats map[string]*FileStat, fileMetaDatas ...*FileMetaData) error {
+	if len(fileMetaDatas) == 0 {
+		return nil
+	}
+	for _, fileMetaData := range fileMetaDatas {
+		committed_FileInfoMap[fileMetaData.Filename] = fileMetaData
+	}
+	if err := local_index.Put(fileMetaDatas, local_FileStats); err != nil {
+		return fmt.Errorf("update local index: %w", err)
 	}
+	return nil
 }
 
-func badStringError(what, val string) error {
-	return fmt.Errorf("%s %q", what, val)
+// changedIndexEntries returns the files of fileMetaDatas whose entry in the
+// local index would change, e.g. a file touched without being modified, so
+// the files already in sync aren't written to the index again by every sync.
+func changedIndexEntries(committed_FileInfoMap map[string]*FileMetaData, committed_FileStats map[string]*FileStat, local_FileStats map[string]*FileStat, fileMetaDatas []*FileMetaData) []*FileMetaData {
+	changed := make([]*FileMetaData, 0)
+	for _, fileMetaData := range fileMetaDatas {
+		filename := fileMetaData.Filename
+		committed_meta_data, ok := committed_FileInfoMap[filename]
+		if !ok || indexEntryToString(committed_meta_data, committed_FileStats[filename]) != indexEntryToString(fileMetaData, local_FileStats[filename]) {
+			changed = append(changed, fileMetaData)
+		}
+	}
+	return changed
+}
+
+// Transfers is the state shared by the file transfers of a sync.
+type Transfers struct {
+	BlockPool   *WorkerPool       // bounds the blocks transferred at the same time
+	LocalBlocks *LocalBlockSource // blocks that don't need to be downloaded, may be nil
+	Journal     *TransferJournal  // progress of the transfers, may be nil
+	Stats       *TransferStats    // blocks and bytes transferred, may be nil
+	Buffers     *BlockBudget      // bounds the blocks held in memory by all the files, may be nil
+
+	// the transfers stop before their next window of blocks once it is
+	// done, keeping their progress in the journal, may be nil
+	Context context.Context
+	// progress messages for the user, discarded if nil
+	Output io.Writer
+}
+
+// interrupted returns why the transfers must stop, nil if they can go on.
+func (transfers *Transfers) interrupted() error {
+	if transfers.Context == nil {
+		return nil
+	}
+	return transfers.Context.Err()
+}
+
+func (transfers *Transfers) printf(format string, a ...interface{}) {
+	if transfers.Output != nil {
+		fmt.Fprintf(transfers.Output, format, a...)
+	}
+}
+
+// NewTransfers prepares the transfers of a sync. Blocks of the files in
+// local_Filehashlists, and of the block cache if the client has one, are
+// reused by downloads. journal may be nil.
+func NewTransfers(client RPCClient, local_Filehashlists map[string][]string, journal *TransferJournal) *Transfers {
+	var block_cache *BlockCache
+	if client.BlockCacheDir != "" {
+		// the cache files would be synced, and deleted by the other clients
+		if inside, err := IsInsideDir(client.BlockCacheDir, client.BaseDir); err != nil || inside {
+			log.Println("Error occured when opening the block cache, it must be outside of the base directory, syncing without it!", client.BlockCacheDir)
+		} else {
+			block_cache, err = OpenBlockCache(client.BlockCacheDir, client.BlockCacheSize)
+			if err != nil {
+				log.Println("Error occured when opening the block cache, syncing without it!", err)
+			}
+		}
+	}
+	return &Transfers{
+		BlockPool:   NewWorkerPool(client.Concurrency),
+		LocalBlocks: NewLocalBlockSource(client, local_Filehashlists, block_cache),
+		Journal:     journal,
+		Stats:       &TransferStats{},
+		Buffers:     NewBlockBudget(TransferBudget(client)),
+	}
 }
 
-func ComputeFileHashlist(client RPCClient) (FileHashlists map[string][]string) {
+// ComputeFileHashlist returns the hash list and stat data of every file in
+// the base directory. A file whose stat data matches the one recorded in the
+// local index (or in the journal of an interrupted upload) is unchanged, and
+// its hash list is taken from there instead of being recomputed, unless
+// client.FullRescan is set. Files are hashed on client.Concurrency
+// goroutines. A file that can't be read is reported as unchanged (or left
+// out if it is new), so it is retried on the next sync. Files (and
+// directories) excluded by sync_filter are skipped.
+func ComputeFileHashlist(client RPCClient, index_FileInfoMap map[string]*FileMetaData, index_FileStats map[string]*FileStat, journal *TransferJournal, sync_filter *SyncFilter) (FileHashlists map[string][]string, FileStats map[string]*FileStat, err error) {
 	files, err := os.ReadDir(client.BaseDir)
 	if err != nil {
-		log.Panicln("Error occured when reading current dir!", err)
+		return nil, nil, fmt.Errorf("read base directory: %w", err)
 	}
 	FileHashlists = make(map[string][]string)
+	FileStats = make(map[string]*FileStat)
+	to_hash_Filenames := make([]string, 0)
+	to_hash_Paths := make(map[string]string)
+	disk_names := make(map[string]bool)
+	for _, file := range files {
+		disk_names[file.Name()] = true
+	}
 	for _, file := range files {
-		if file.IsDir() {
-			log.Panicln("Subdir exists in current dir!", err)
-		} else if file.Name() == "index.txt" || file.Name() == ".DS_Store" {
+		// files are known by the NFC form of their name, whatever the form on disk
+		filename := NormalizeFilename(file.Name())
+		path := client.BaseDir + "/" + file.Name()
+		if !file.IsDir() && (IsIndexFile(filename) || filename == ".DS_Store" || IsTempFile(filename)) {
 			// } else if file.Name() == "index.txt" {
 			continue
+		} else if sync_filter.Excluded(filename, file.IsDir()) {
+			continue
+		} else if file.IsDir() {
+			return nil, nil, fmt.Errorf("subdirectory %s in base directory, which can't be synced", file.Name())
+		} else if filename != file.Name() && disk_names[filename] {
+			log.Println("Another file has the normalized name, skipped!", file.Name())
+			continue
 		} else {
-			f, _ := os.Open(client.BaseDir + "/" + file.Name())
-			defer f.Close()
-			local_hashlist := make([]string, 0)
-			for {
-				buffer := make([]byte, client.BlockSize)
-				bytes, err := f.Read(buffer)
+			info, err := file.Info()
+			if err != nil {
+				log.Println("Stat file error!", err)
+				continue
+			}
+			local_stat := NewFileStat(info)
+			if info.Mode()&os.ModeSymlink != 0 {
+				local_stat, err = NewLinkStat(path, info)
 				if err != nil {
-					if err == io.EOF {
-						break
-					} else {
-						log.Panicln("Read file error!", err)
+					log.Println("Read link error!", err)
+					continue
+				}
+				if IsSymlinkOutside(local_stat.LinkTarget) && client.SymlinkPolicy == SYMLINK_POLICY_FOLLOW {
+					// synced as the file it points to
+					info, err = os.Stat(path)
+					if err != nil || !info.Mode().IsRegular() {
+						log.Println("Symlink doesn't point to a regular file!", file.Name(), err)
+						continue
 					}
+					local_stat = NewFileStat(info)
+				} else if IsSymlinkOutside(local_stat.LinkTarget) && client.SymlinkPolicy != SYMLINK_POLICY_KEEP {
+					sync_filter.skipLink(filename)
+					continue
+				} else {
+					// the hash list of a symlink is cheap, it is always recomputed
+					FileStats[filename] = local_stat
+					FileHashlists[filename] = LinkHashlist(local_stat.LinkTarget, client.BlockSize)
+					continue
 				}
-				local_hashlist = append(local_hashlist, GetBlockHashString(buffer[:bytes]))
 			}
-			FileHashlists[file.Name()] = local_hashlist
+			FileStats[filename] = local_stat
+
+			journal_hashlist, journal_content_hash, in_journal := journal.UploadHashlist(filename, local_stat)
+			if index_meta_data, ok := index_FileInfoMap[filename]; ok && !client.FullRescan && local_stat.Unchanged(index_FileStats[filename]) {
+				FileHashlists[filename] = index_meta_data.BlockHashList
+				local_stat.ContentHash = index_meta_data.ContentHash
+			} else if in_journal && !client.FullRescan {
+				FileHashlists[filename] = journal_hashlist
+				local_stat.ContentHash = journal_content_hash
+			} else {
+				to_hash_Filenames = append(to_hash_Filenames, filename)
+				to_hash_Paths[filename] = path
+			}
 		}
 	}
-	return FileHashlists
-}
 
-func GitAdd(client RPCClient, local_Filehashlists map[string][]string, BaseDir string) map[string]*FileMetaData {
-	local_meta_map := make(map[string]*FileMetaData)
-	_, err := os.Stat(BaseDir + "/index.txt")
-	if os.IsNotExist(err) {
-		for filename, filehashlist := range local_Filehashlists {
-			local_meta_map[filename] = &FileMetaData{Filename: filename, Version: 1, BlockHashList: filehashlist}
-		}
-		return local_meta_map
-	} else if err != nil {
-		log.Panicln("Error occured when reading current dir in GitAdd!", err)
+	hashlists := make([][]string, len(to_hash_Filenames))
+	content_hashes := make([]string, len(to_hash_Filenames))
+	hash_errs := make([]error, len(to_hash_Filenames))
+	NewWorkerPool(client.Concurrency).Run(len(to_hash_Filenames), func(i int) error {
+		hashlists[i], content_hashes[i], hash_errs[i] = HashFile(to_hash_Paths[to_hash_Filenames[i]], client.BlockSize)
 		return nil
-	} else {
-		local_meta_map, err := LoadMetaFromMetaFile(BaseDir)
-		if err != nil {
-			log.Panicln("Error occured when call LoadMetaFromMetaFile api!", err)
+	})
+	for i, filename := range to_hash_Filenames {
+		if hash_errs[i] != nil {
+			log.Println("Read file error!", hash_errs[i])
+			delete(FileStats, filename)
+			if index_meta_data, ok := index_FileInfoMap[filename]; ok {
+				FileHashlists[filename] = index_meta_data.BlockHashList
+			}
+			continue
 		}
-		for filename, local_hashlist := range local_Filehashlists {
-			if map_value, ok := local_meta_map[filename]; !ok {
-				// (1) there are now new files in the base directory that aren’t in the index file
-				local_meta_map[filename] = &FileMetaData{Filename: filename, Version: 1, BlockHashList: local_hashlist}
-			} else {
-				// (2) files that are in the index file, but have changed since the last time the client was executed
-				if !CompareHashlist(map_value.BlockHashList, local_hashlist) {
-					local_meta_map[filename] = &FileMetaData{Filename: filename, Version: map_value.Version + 1, BlockHashList: local_hashlist}
-				}
+		FileHashlists[filename] = hashlists[i]
+		FileStats[filename].ContentHash = content_hashes[i]
+	}
+	return FileHashlists, FileStats, nil
+}
+
+// HashFile returns the hash list of the file at path, split in blocks of
+// blockSize bytes, and the hash of its whole content.
+func HashFile(path string, blockSize int) ([]string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	local_hashlist, _, content_hash, err := HashReader(f, blockSize)
+	return local_hashlist, content_hash, err
+}
+
+// HashReader returns the hash list of the content of r, split in blocks of
+// blockSize bytes, the size of the content and the hash of the whole content.
+func HashReader(r io.Reader, blockSize int) ([]string, int64, string, error) {
+	local_hashlist := make([]string, 0)
+	var size int64
+	content_digest := sha256.New()
+	buffer := make([]byte, blockSize)
+	for {
+		bytes, err := io.ReadFull(r, buffer)
+		size += int64(bytes)
+		if bytes > 0 {
+			local_hashlist = append(local_hashlist, GetBlockHashString(buffer[:bytes]))
+			content_digest.Write(buffer[:bytes])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, 0, "", err
+		}
+	}
+	return local_hashlist, size, hex.EncodeToString(content_digest.Sum(nil)), nil
+}
+
+// VerifyContent checks the size and content hash of a downloaded file
+// against its metadata. Either is skipped if the uploader didn't send it.
+func VerifyContent(fileMetaData *FileMetaData, size int64, content_hash string) error {
+	if (fileMetaData.Size > 0 || fileMetaData.ContentHash != "") && size != fileMetaData.Size {
+		return fmt.Errorf("%s: got %d bytes, version %d has %d", fileMetaData.Filename, size, fileMetaData.Version, fileMetaData.Size)
+	}
+	if fileMetaData.ContentHash != "" && content_hash != fileMetaData.ContentHash {
+		return fmt.Errorf("%s: content doesn't match the hash of version %d", fileMetaData.Filename, fileMetaData.Version)
+	}
+	return nil
+}
+
+// GitAdd compares the hash lists and permissions of the local files with the
+// local index, and returns the index updated with the new, changed and
+// deleted files. A file without stat data is treated as unchanged.
+func GitAdd(client RPCClient, local_Filehashlists map[string][]string, local_FileStats map[string]*FileStat, index_FileInfoMap map[string]*FileMetaData) (map[string]*FileMetaData, error) {
+	local_meta_map := make(map[string]*FileMetaData)
+	for filename, index_meta_data := range index_FileInfoMap {
+		local_meta_map[filename] = index_meta_data
+	}
+
+	for filename, local_hashlist := range local_Filehashlists {
+		local_stat := local_FileStats[filename]
+		if map_value, ok := local_meta_map[filename]; !ok {
+			// (1) there are now new files in the base directory that aren’t in the index file
+			local_meta_map[filename] = NewFileMetaData(filename, 1, local_hashlist, local_stat)
+		} else {
+			// (2) files that are in the index file, but have changed since the last time the client was executed
+			// a change of permissions only is a new version too, unless the permissions in the index are unknown
+			mode_changed := local_stat != nil && map_value.Mode != 0 && map_value.Mode != local_stat.Mode
+			// so is a file replaced by a symlink, or the opposite
+			type_changed := local_stat != nil && isSymlink(map_value) != (local_stat.LinkTarget != "")
+			if !CompareHashlist(map_value.BlockHashList, local_hashlist) || mode_changed || type_changed {
+				local_meta_map[filename] = NewFileMetaData(filename, map_value.Version+1, local_hashlist, local_stat)
 			}
 		}
+	}
 
-		// when one file is in index.txt, but not in the curr dir, this file is deleted
-		for filename := range local_meta_map {
-			if _, ok := local_Filehashlists[filename]; !ok {
-				// get remote_FileInfoMap
-				var remote_FileInfoMap map[string]*FileMetaData
-				err := client.GetFileInfoMap(&remote_FileInfoMap)
-				if err != nil {
-					log.Panicln("Error occured when call client.GetFileInfoMap API!", err)
-				}
-				if _, ok := remote_FileInfoMap[filename]; ok && (len(remote_FileInfoMap[filename].BlockHashList) == 1 && remote_FileInfoMap[filename].BlockHashList[0] == "0") {
-					local_meta_map[filename] = &FileMetaData{Filename: filename, Version: local_meta_map[filename].Version, BlockHashList: []string{"0"}}
-				} else {
-					local_meta_map[filename] = &FileMetaData{Filename: filename, Version: local_meta_map[filename].Version + 1, BlockHashList: []string{"0"}}
+	// when one file is in index.txt, but not in the curr dir, this file is deleted
+	var remote_FileInfoMap map[string]*FileMetaData
+	for filename := range local_meta_map {
+		if _, ok := local_Filehashlists[filename]; !ok {
+			// get remote_FileInfoMap, once
+			if remote_FileInfoMap == nil {
+				if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+					return nil, fmt.Errorf("get file info map: %w", err)
 				}
 			}
+			if _, ok := remote_FileInfoMap[filename]; ok && IsDeleted(remote_FileInfoMap[filename]) {
+				local_meta_map[filename] = NewTombstone(filename, local_meta_map[filename].Version)
+			} else {
+				local_meta_map[filename] = NewTombstone(filename, local_meta_map[filename].Version+1)
+			}
+		}
+	}
+	return local_meta_map, nil
+}
+
+// NewFileMetaData returns the metadata of a version of a local file, with the
+// permissions, modification time and symlink target of local_stat if it
+// isn't nil.
+func NewFileMetaData(filename string, version int32, hashlist []string, local_stat *FileStat) *FileMetaData {
+	fileMetaData := &FileMetaData{Filename: filename, Version: version, BlockHashList: hashlist}
+	if local_stat != nil {
+		fileMetaData.Mode = local_stat.Mode
+		fileMetaData.ModTime = local_stat.ModTime
+		fileMetaData.ContentHash = local_stat.ContentHash
+		if local_stat.LinkTarget != "" {
+			fileMetaData.Type = FileType_SYMLINK
+			fileMetaData.LinkTarget = local_stat.LinkTarget
 		}
-		return local_meta_map
 	}
+	return fileMetaData
 }
 
 func CompareHashlist(hashlist1 []string, hashlist2 []string) bool {
@@ -161,110 +663,442 @@ func CompareHashlist(hashlist1 []string, hashlist2 []string) bool {
 	return true
 }
 
-func Download_helper(client RPCClient, filename string, local_FileInfoMap *map[string]*FileMetaData, remote_FileInfoMap *map[string]*FileMetaData) {
-	// the current file is a deleted file
-	deleted_flag := false
-	if len((*remote_FileInfoMap)[filename].BlockHashList) == 1 && (*remote_FileInfoMap)[filename].BlockHashList[0] == "0" {
-		deleted_flag = true
-	}
+// Download_helper makes the local copy of a file match remote_meta_data.
+// Blocks found in transfers.LocalBlocks are reused, the others are fetched
+// on transfers.BlockPool. The local file is left untouched if an error is
+// returned, and a download interrupted by an error (or a crash) resumes
+// from its journaled progress on the next sync.
+func Download_helper(client RPCClient, transfers *Transfers, remote_meta_data *FileMetaData) error {
+	filename := remote_meta_data.Filename
 
-	if deleted_flag {
-		(*local_FileInfoMap)[filename] = &FileMetaData{Filename: filename, Version: (*local_FileInfoMap)[filename].Version + 1, BlockHashList: []string{"0"}}
-		_, err := os.Stat(client.BaseDir + "/" + filename)
+	// the current file is a deleted file
+	if IsDeleted(remote_meta_data) {
+		_, err := os.Lstat(client.BaseDir + "/" + filename)
 		if err == nil {
 			err := os.Remove(client.BaseDir + "/" + filename)
 			if err != nil {
-				log.Panicln("Error occured when delete file!", err)
-			} else {
-				log.Println("Delete file successfully!")
-				return
+				return fmt.Errorf("delete %s: %w", filename, err)
 			}
+			log.Println("Delete file successfully!")
+		}
+		return nil
+	}
+
+	if isSymlink(remote_meta_data) {
+		if err := CreateSymlink(remote_meta_data.LinkTarget, client.BaseDir+"/"+filename); err != nil {
+			return fmt.Errorf("link %s: %w", filename, err)
 		}
+		return nil
 	}
 
-	// get needed blocks from server
-	remote_hash_list := (*remote_FileInfoMap)[filename].BlockHashList
+	// get needed blocks from server, a window of blocks at a time, and stream
+	// them into a temp file which only replaces the original once it is complete
+	remote_hash_list := remote_meta_data.BlockHashList
 	var BlockStoreAddr string
 	err := client.GetBlockStoreAddr(&BlockStoreAddr)
 	if err != nil {
-		log.Panicln("Error occured when call client.GetBlockStoreAddr API!", err)
+		return fmt.Errorf("get block store address: %w", err)
 	}
-	hash_block_lists := (*remote_FileInfoMap)[filename].BlockHashList
-	local_block_map := make(map[string]Block)
-	for _, hash_block_list := range hash_block_lists {
-		var block Block
-		client.GetBlock(hash_block_list, BlockStoreAddr, &block)
-		local_block_map[hash_block_list] = block
+	var af *AtomicFile
+	var offset int64
+	start := 0
+	if temp_path, blocks_done, done_offset, ok := transfers.Journal.ResumeDownload(remote_meta_data); ok {
+		af, err = OpenAtomicFile(temp_path, client.BaseDir+"/"+filename, done_offset)
+		if err != nil {
+			transfers.Journal.abandon(filename)
+		} else {
+			start, offset = blocks_done, done_offset
+		}
 	}
+	// the content written is hashed to be verified once complete, starting
+	// with what an interrupted download already wrote
+	content_digest := sha256.New()
+	if af != nil {
+		if err := hashWrittenBlocks(af, offset, remote_hash_list[:start], client.BlockSize, content_digest); err != nil {
+			log.Println("Error occured when checking the partial download, starting over!", filename, err)
+			af.Abort()
+			transfers.Journal.abandon(filename)
+			af, start, offset = nil, 0, 0
+			content_digest.Reset()
+		} else {
+			transfers.printf("Resuming download of %s: %d/%d blocks already done\n", filename, start, len(remote_hash_list))
+		}
+	}
+	if af == nil {
+		af, err = CreateAtomicFile(client.BaseDir + "/" + filename)
+		if err != nil {
+			return fmt.Errorf("create temp file for %s: %w", filename, err)
+		}
+		transfers.Journal.StartDownload(remote_meta_data, af.Name())
+	}
+	// the temp file is discarded if it can't be completed, and kept to resume from otherwise
+	abort := func() {
+		af.Abort()
+		transfers.Journal.Done(filename)
+	}
+
+	// blocks already written, a repeated block is copied from the temp file instead of fetched again
+	written_blocks := make(map[string]blockLocation)
+	var fetched_count int64
+	window := TransferWindow(client)
+	for start < len(remote_hash_list) {
+		if err := transfers.interrupted(); err != nil {
+			af.Close()
+			return fmt.Errorf("download %s: %w", filename, err)
+		}
+		// the window ends after `window` blocks that have to be fetched
+		end, fetch_hash_list := start, make([]string, 0, window)
+		fetching := make(map[string]bool)
+		for ; end < len(remote_hash_list) && len(fetch_hash_list) < window; end++ {
+			hash := remote_hash_list[end]
+			if _, ok := written_blocks[hash]; !ok && !fetching[hash] {
+				fetching[hash] = true
+				fetch_hash_list = append(fetch_hash_list, hash)
+			}
+		}
+
+		reserved := transfers.Buffers.Acquire(len(fetch_hash_list))
+		blocks := make([]*Block, len(fetch_hash_list))
+		err = transfers.BlockPool.Run(len(fetch_hash_list), func(i int) error {
+			if data := transfers.LocalBlocks.GetBlock(fetch_hash_list[i]); data != nil {
+				blocks[i] = &Block{BlockData: data, BlockSize: int32(len(data))}
+				return nil
+			}
+			blocks[i] = &Block{}
+			if err := client.GetBlock(fetch_hash_list[i], BlockStoreAddr, blocks[i]); err != nil {
+				return fmt.Errorf("get block %s of %s: %w", fetch_hash_list[i], filename, err)
+			}
+			if GetBlockHashString(blocks[i].BlockData) != fetch_hash_list[i] {
+				return fmt.Errorf("get block %s of %s: content doesn't match its hash", fetch_hash_list[i], filename)
+			}
+			transfers.LocalBlocks.AddBlock(fetch_hash_list[i], blocks[i].BlockData)
+			atomic.AddInt64(&fetched_count, 1)
+			transfers.Stats.downloaded(len(blocks[i].BlockData))
+			return nil
+		})
+		if err != nil {
+			transfers.Buffers.Release(reserved)
+			af.Close()
+			return err
+		}
+		fetched_blocks := make(map[string]*Block)
+		for i, hash := range fetch_hash_list {
+			fetched_blocks[hash] = blocks[i]
+		}
 
-	// concat blocks to restore the file
-	buff := make([]byte, 0)
-	for _, hash := range remote_hash_list {
-		buff = append(buff, local_block_map[hash].BlockData...)
+		for ; start < end; start++ {
+			hash := remote_hash_list[start]
+			var data []byte
+			if block, ok := fetched_blocks[hash]; ok {
+				data = block.BlockData
+			} else {
+				location := written_blocks[hash]
+				data = make([]byte, location.size)
+				if _, err := af.ReadAt(data, location.offset); err != nil {
+					transfers.Buffers.Release(reserved)
+					abort()
+					return fmt.Errorf("read back %s: %w", filename, err)
+				}
+			}
+			if _, ok := written_blocks[hash]; !ok {
+				written_blocks[hash] = blockLocation{offset: offset, size: len(data)}
+			}
+			if _, err := af.Write(data); err != nil {
+				transfers.Buffers.Release(reserved)
+				abort()
+				return fmt.Errorf("write %s: %w", filename, err)
+			}
+			content_digest.Write(data)
+			offset += int64(len(data))
+		}
+		transfers.Buffers.Release(reserved)
+		// the journal must not claim more than what would survive a crash
+		if err := af.Sync(); err != nil {
+			abort()
+			return fmt.Errorf("write %s: %w", filename, err)
+		}
+		transfers.Journal.Progress(filename, start, offset)
+	}
+	if err := VerifyContent(remote_meta_data, offset, hex.EncodeToString(content_digest.Sum(nil))); err != nil {
+		abort()
+		return err
 	}
-	ioutil.WriteFile(client.BaseDir+"/"+filename, buff, 0644)
 
-	// update local_FileInfoMap
-	(*local_FileInfoMap)[filename] = (*remote_FileInfoMap)[filename]
+	// the file keeps the permissions and modification time it had where it was uploaded
+	if remote_meta_data.ModTime != 0 {
+		if err := os.Chtimes(af.Name(), time.Now(), time.Unix(0, remote_meta_data.ModTime)); err != nil {
+			abort()
+			return fmt.Errorf("set modification time of %s: %w", filename, err)
+		}
+	}
+	err = af.Commit(FileModeOf(remote_meta_data))
+	transfers.Journal.Done(filename)
+	if err != nil {
+		return fmt.Errorf("replace %s: %w", filename, err)
+	}
+	log.Println("Downloaded", filename, "fetching", fetched_count, "of", len(written_blocks), "distinct blocks")
+	return nil
 }
 
-func Upload_helper(client RPCClient, filename string, local_FileInfoMap *map[string]*FileMetaData, deleted_flag bool) {
-	if !deleted_flag {
+// hashWrittenBlocks checks that the first size bytes of the temp file of an
+// interrupted download are the blocks of hash_list, all block_size bytes
+// long but the last one, and adds them to digest.
+func hashWrittenBlocks(f io.ReaderAt, size int64, hash_list []string, block_size int, digest io.Writer) error {
+	if block_size < 1 {
+		return fmt.Errorf("invalid block size %d", block_size)
+	}
+	r := io.NewSectionReader(f, 0, size)
+	buffer := make([]byte, block_size)
+	for i, hash := range hash_list {
+		bytes, err := io.ReadFull(r, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("read block %d: %w", i, err)
+		}
+		if GetBlockHashString(buffer[:bytes]) != hash {
+			return fmt.Errorf("block %d doesn't match its hash", i)
+		}
+		digest.Write(buffer[:bytes])
+	}
+	if bytes, _ := r.Read(buffer); bytes != 0 {
+		return fmt.Errorf("more than %d blocks written", len(hash_list))
+	}
+	return nil
+}
+
+// FileModeOf returns the permissions of a file, 0644 if they are unknown.
+func FileModeOf(fileMetaData *FileMetaData) os.FileMode {
+	if fileMetaData.Mode == 0 {
+		return 0644
+	}
+	return os.FileMode(fileMetaData.Mode) & os.ModePerm
+}
+
+// blockLocation is where a block was written in a file being downloaded.
+type blockLocation struct {
+	offset int64
+	size   int
+}
+
+// TransferBudget is the number of blocks all the files transferred by a sync
+// keep in memory together, see Transfers.Buffers, or a single file
+// transferred on its own.
+func TransferBudget(client RPCClient) int {
+	if client.Concurrency < 1 {
+		return TRANSFER_WINDOW_PER_WORKER
+	}
+	return TRANSFER_WINDOW_PER_WORKER * client.Concurrency
+}
+
+// TransferWindow is the number of blocks of a file a sync keeps in memory
+// while transferring it, its share of TransferBudget, so the files
+// transferred in parallel never wait on each other for the budget.
+func TransferWindow(client RPCClient) int {
+	if client.Concurrency < 1 {
+		return TransferBudget(client)
+	}
+	return TransferBudget(client) / client.Concurrency
+}
+
+// Upload_helper uploads the blocks of a local file missing from the
+// BlockStore on transfers.BlockPool, then updates the file's remote
+// metadata. The file is read a window of blocks at a time, and an upload
+// interrupted by an error (or a crash) skips the blocks it already uploaded
+// on the next sync. local_stat is the stat data of the file when it was hashed.
+// The update fails with a VersionConflictError unless the version of the
+// file on the server is expected_version (NO_FILE_VERSION for a new file).
+func Upload_helper(client RPCClient, transfers *Transfers, local_meta_data *FileMetaData, local_stat *FileStat, deleted_flag bool, expected_version int32) error {
+	filename := local_meta_data.Filename
+	if !deleted_flag && isSymlink(local_meta_data) {
+		// the block of a symlink is its target
 		var BlockStoreAddr string
 		err := client.GetBlockStoreAddr(&BlockStoreAddr)
 		if err != nil {
-			log.Panicln("Error occured when call client.GetBlockStoreAddr API!", err)
+			return fmt.Errorf("get block store address: %w", err)
+		}
+		missing_hash_set, err := MissingBlocks(client, BlockStoreAddr, local_meta_data.BlockHashList)
+		if err != nil {
+			return fmt.Errorf("check blocks of %s: %w", filename, err)
+		}
+		if err := PutBlocks(client, transfers, BlockStoreAddr, strings.NewReader(local_meta_data.LinkTarget), local_meta_data, 0, missing_hash_set); err != nil {
+			return err
+		}
+		local_meta_data.Size = int64(len(local_meta_data.LinkTarget))
+	} else if !deleted_flag {
+		var BlockStoreAddr string
+		err := client.GetBlockStoreAddr(&BlockStoreAddr)
+		if err != nil {
+			return fmt.Errorf("get block store address: %w", err)
 		}
 
-		remote_exist_hash_list := make([]string, 0)
-		client.HasBlocks((*local_FileInfoMap)[filename].BlockHashList, BlockStoreAddr, &remote_exist_hash_list)
+		resume_from := transfers.Journal.StartUpload(local_meta_data, local_stat)
+		if resume_from > 0 {
+			transfers.printf("Resuming upload of %s: %d/%d blocks already done\n", filename, resume_from, len(local_meta_data.BlockHashList))
+		}
 
-		remote_exist_hash_list_set := make(map[string]bool)
-		// go doesn't support in-built set, so we use hashmap
-		for _, i := range remote_exist_hash_list {
-			remote_exist_hash_list_set[i] = true
+		missing_hash_set, err := MissingBlocks(client, BlockStoreAddr, local_meta_data.BlockHashList[resume_from:])
+		if err != nil {
+			return fmt.Errorf("check blocks of %s: %w", filename, err)
 		}
 
-		// upload blocks that doesn't exist in metastore server
-		blocks_map := GetBlocksHelper(client, filename) // can optimize, only get a blocks_map which only contains keys that are not in client.HasBlocks()
-		for _, key := range (*local_FileInfoMap)[filename].BlockHashList {
-			if _, ok := remote_exist_hash_list_set[key]; !ok {
-				tmp := blocks_map[key]
-				var succ bool
-				client.PutBlock(&tmp, BlockStoreAddr, &succ)
-				if !succ {
-					log.Panicln("Error occured when call client.PutBlock API!")
-				}
-			}
+		// upload blocks that doesn't exist in blockstore server
+		f, err := os.Open(client.BaseDir + "/" + filename)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", filename, err)
+		}
+		defer f.Close()
+		if _, err := f.Seek(int64(resume_from)*int64(client.BlockSize), io.SeekStart); err != nil {
+			return fmt.Errorf("read %s: %w", filename, err)
+		}
+		if err := PutBlocks(client, transfers, BlockStoreAddr, f, local_meta_data, resume_from, missing_hash_set); err != nil {
+			return err
+		}
+		if local_stat != nil {
+			local_meta_data.Size = local_stat.Size
 		}
 	}
 
 	// upload remote index
 	var latestVersion int32
-	tmp := (*local_FileInfoMap)[filename]
-	err := client.UpdateFile(tmp, &latestVersion)
+	err := client.UpdateFileIf(local_meta_data, expected_version, &latestVersion)
 	if err != nil {
-		log.Panicln("Error occured when call client.UpdateFile API!", err)
+		return fmt.Errorf("update %s: %w", filename, err)
 	}
+	transfers.Journal.Done(filename)
+	return nil
 }
 
-func GetBlocksHelper(client RPCClient, filename string) (block_map map[string]Block) {
-	f, _ := os.Open(client.BaseDir + "/" + filename)
-	defer f.Close()
-	block_map = make(map[string]Block)
-	for {
-		buffer := make([]byte, client.BlockSize)
-		bytes, err := f.Read(buffer)
+// Rename_helper renames a file on the server, with the deletion of the old
+// name and the new version of the new name in fileRename. local_stat is the
+// stat data of the renamed file.
+func Rename_helper(client RPCClient, fileRename *FileRename, local_stat *FileStat) error {
+	if local_stat != nil {
+		fileRename.To.Size = local_stat.Size
+	}
+	var latestVersion int32
+	if err := client.RenameFile(fileRename.From, fileRename.To, &latestVersion); err != nil {
+		return fmt.Errorf("rename %s to %s: %w", fileRename.From.Filename, fileRename.To.Filename, err)
+	}
+	return nil
+}
+
+// LocalRename_helper applies a rename done on the server to the base
+// directory, giving the file the permissions and modification time of its
+// new version.
+func LocalRename_helper(client RPCClient, fileRename *FileRename) error {
+	from_path := client.BaseDir + "/" + fileRename.From.Filename
+	to_path := client.BaseDir + "/" + fileRename.To.Filename
+	if err := os.Rename(from_path, to_path); err != nil {
+		return fmt.Errorf("rename %s to %s: %w", fileRename.From.Filename, fileRename.To.Filename, err)
+	}
+	if err := os.Chmod(to_path, FileModeOf(fileRename.To)); err != nil {
+		return fmt.Errorf("set permissions of %s: %w", fileRename.To.Filename, err)
+	}
+	if fileRename.To.ModTime != 0 {
+		if err := os.Chtimes(to_path, time.Now(), time.Unix(0, fileRename.To.ModTime)); err != nil {
+			return fmt.Errorf("set modification time of %s: %w", fileRename.To.Filename, err)
+		}
+	}
+	return syncDir(client.BaseDir)
+}
+
+// PutBlocks reads the blocks of a file from r, starting at block
+// resume_from, and puts the ones in missing_hash_set on transfers.BlockPool,
+// a window of blocks at a time. It fails if the content read doesn't match
+// the hash list of local_meta_data.
+func PutBlocks(client RPCClient, transfers *Transfers, BlockStoreAddr string, r io.Reader, local_meta_data *FileMetaData, resume_from int, missing_hash_set map[string]bool) error {
+	filename := local_meta_data.Filename
+	window := TransferWindow(client)
+	for start := resume_from; start < len(local_meta_data.BlockHashList); start += window {
+		if err := transfers.interrupted(); err != nil {
+			return fmt.Errorf("upload %s: %w", filename, err)
+		}
+		end := start + window
+		if end > len(local_meta_data.BlockHashList) {
+			end = len(local_meta_data.BlockHashList)
+		}
+
+		reserved := transfers.Buffers.Acquire(end - start)
+		put_blocks := make([]*Block, 0, window)
+		for i := start; i < end; i++ {
+			buffer := make([]byte, client.BlockSize)
+			bytes, err := io.ReadFull(r, buffer)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				transfers.Buffers.Release(reserved)
+				return fmt.Errorf("read %s: %w", filename, err)
+			}
+			hash := GetBlockHashString(buffer[:bytes])
+			if hash != local_meta_data.BlockHashList[i] {
+				transfers.Buffers.Release(reserved)
+				transfers.Journal.Done(filename)
+				return fmt.Errorf("%s changed while syncing", filename)
+			}
+			if missing_hash_set[hash] {
+				// only the first occurrence of a block is uploaded
+				delete(missing_hash_set, hash)
+				put_blocks = append(put_blocks, &Block{BlockData: buffer[:bytes], BlockSize: int32(bytes)})
+			}
+		}
+
+		err := transfers.BlockPool.Run(len(put_blocks), func(i int) error {
+			var succ bool
+			if err := client.PutBlock(put_blocks[i], BlockStoreAddr, &succ); err != nil {
+				return fmt.Errorf("put block of %s: %w", filename, err)
+			} else if !succ {
+				return fmt.Errorf("put block of %s: rejected by the BlockStore", filename)
+			}
+			transfers.Stats.uploaded(len(put_blocks[i].BlockData))
+			return nil
+		})
+		transfers.Buffers.Release(reserved)
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				log.Panicln("Read file error!", err)
+			return err
+		}
+		transfers.Journal.Progress(filename, end, 0)
+	}
+	return nil
+}
+
+// MissingBlocks returns the set of hashes of hash_list that are not stored
+// in the BlockStore. HasBlocks is called in batches, to keep each request
+// small for huge files.
+func MissingBlocks(client RPCClient, blockStoreAddr string, hash_list []string) (map[string]bool, error) {
+	missing_hash_set := make(map[string]bool)
+	distinct_hash_list := DistinctHashes(hash_list)
+	for start := 0; start < len(distinct_hash_list); start += HAS_BLOCKS_BATCH_SIZE {
+		end := start + HAS_BLOCKS_BATCH_SIZE
+		if end > len(distinct_hash_list) {
+			end = len(distinct_hash_list)
+		}
+		remote_exist_hash_list := make([]string, 0)
+		err := client.HasBlocks(distinct_hash_list[start:end], blockStoreAddr, &remote_exist_hash_list)
+		if err != nil {
+			return nil, err
+		}
+
+		// go doesn't support in-built set, so we use hashmap
+		remote_exist_hash_list_set := make(map[string]bool)
+		for _, i := range remote_exist_hash_list {
+			remote_exist_hash_list_set[i] = true
+		}
+		for _, hash := range distinct_hash_list[start:end] {
+			if !remote_exist_hash_list_set[hash] {
+				missing_hash_set[hash] = true
 			}
 		}
-		hashBytes := sha256.Sum256(buffer[:bytes])
-		hashString := hex.EncodeToString(hashBytes[:])
-		block_map[hashString] = Block{BlockData: buffer[:bytes], BlockSize: int32(bytes)}
 	}
-	return block_map
+	return missing_hash_set, nil
+}
+
+// DistinctHashes returns the hashes of hash_list without duplicates, in
+// order of first occurrence.
+func DistinctHashes(hash_list []string) []string {
+	seen := make(map[string]bool)
+	distinct := make([]string, 0, len(hash_list))
+	for _, hash := range hash_list {
+		if !seen[hash] {
+			seen[hash] = true
+			distinct = append(distinct, hash)
+		}
+	}
+	return distinct
 }
@@ -0,0 +1,251 @@
+package surfstore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// startTestServer serves a MetaStore and a BlockStore on a local port until
+// the end of the test, and returns its address.
+func startTestServer(t *testing.T) string {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	RegisterMetaStoreServer(grpcServer, NewMetaStore(lis.Addr().String()))
+	RegisterBlockStoreServer(grpcServer, NewBlockStore())
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+	return lis.Addr().String()
+}
+
+// newTestClient returns a client syncing a new base directory with the
+// server at addr, with small blocks.
+func newTestClient(t *testing.T, addr string) RPCClient {
+	return NewSurfstoreRPCClient(addr, t.TempDir(), 4)
+}
+
+// testSync syncs the base directory of client, failing the test if the sync
+// can't run or a file fails.
+func testSync(t *testing.T, client RPCClient) *SyncReport {
+	t.Helper()
+	report, err := Sync(context.Background(), SyncOptions{Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range report.Failed() {
+		t.Errorf("%s of %s failed: %v", result.Action, result.Filename, result.Err)
+	}
+	return report
+}
+
+// writeTestFiles writes the files of the base directory of client.
+func writeTestFiles(t *testing.T, client RPCClient, files map[string]string) {
+	t.Helper()
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(client.BaseDir, filename), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChangedIndexEntries(t *testing.T) {
+	a1 := &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}}
+	stat := &FileStat{Size: 1, ModTime: 2, Inode: 3}
+	committed_FileInfoMap := map[string]*FileMetaData{"a": a1}
+	committed_FileStats := map[string]*FileStat{"a": stat}
+
+	tests := []struct {
+		name       string
+		fileMeta   *FileMetaData
+		local_stat *FileStat
+		changed    bool
+	}{
+		{"in sync", &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}}, &FileStat{Size: 1, ModTime: 2, Inode: 3, Mode: 0644, ContentHash: hashB}, false},
+		{"touched", a1, &FileStat{Size: 1, ModTime: 5, Inode: 3}, true},
+		{"copied", a1, &FileStat{Size: 1, ModTime: 2, Inode: 4}, true},
+		{"stat data missing", a1, nil, true},
+		{"other version", &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{hashA}}, stat, true},
+		{"other attributes", &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}, Mode: 0755}, stat, true},
+		{"not in the index", &FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{hashA}}, stat, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local_FileStats := map[string]*FileStat{}
+			if test.local_stat != nil {
+				local_FileStats[test.fileMeta.Filename] = test.local_stat
+			}
+			changed := changedIndexEntries(committed_FileInfoMap, committed_FileStats, local_FileStats, []*FileMetaData{test.fileMeta})
+			if (len(changed) == 1) != test.changed {
+				t.Errorf("changed entries %v, want changed: %v", changed, test.changed)
+			}
+		})
+	}
+}
+
+func TestSyncKeepsIndexOfFilesInSync(t *testing.T) {
+	for _, indexType := range []string{INDEX_TYPE_TEXT, INDEX_TYPE_BOLT} {
+		t.Run(indexType, func(t *testing.T) {
+			client := newTestClient(t, startTestServer(t))
+			client.IndexType = indexType
+			writeTestFiles(t, client, map[string]string{"a": "hello", "b": "world"})
+			testSync(t, client)
+
+			indexPath := filepath.Join(client.BaseDir, DEFAULT_META_FILENAME)
+			if indexType == INDEX_TYPE_BOLT {
+				indexPath = filepath.Join(client.BaseDir, DEFAULT_META_DB_FILENAME)
+			}
+			before, err := os.Stat(indexPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testSync(t, client)
+			after, err := os.Stat(indexPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(before, after) || !before.ModTime().Equal(after.ModTime()) || before.Size() != after.Size() {
+				t.Errorf("index rewritten by a sync with nothing to do")
+			}
+			if _, err := os.Stat(metaLogPath(filepath.Join(client.BaseDir, DEFAULT_META_FILENAME))); !os.IsNotExist(err) {
+				t.Errorf("index.log left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestSyncReportsSkippedAndFilteredFiles(t *testing.T) {
+	client := newTestClient(t, startTestServer(t))
+	writeTestFiles(t, client, map[string]string{
+		IGNORE_FILENAME: "*.log\nnode_modules/\n",
+		"a":             "hello",
+		"debug.log":     "ignored",
+	})
+	if err := os.Mkdir(filepath.Join(client.BaseDir, "node_modules"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/hosts", filepath.Join(client.BaseDir, "hosts")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		report := testSync(t, client)
+		if report.Filtered != 2 {
+			t.Errorf("sync %d: %d files filtered, want debug.log and node_modules", i, report.Filtered)
+		}
+		if report.Skipped != 1 {
+			t.Errorf("sync %d: %d files skipped, want the hosts symlink", i, report.Skipped)
+		}
+		for _, result := range report.Files {
+			if result.Action == SYNC_ACTION_SKIP && result.Filename != "hosts" {
+				t.Errorf("sync %d: %s reported as skipped", i, result.Filename)
+			}
+		}
+	}
+}
+
+func TestTransferWindowsFitInBudget(t *testing.T) {
+	for _, concurrency := range []int{0, 1, 3, DEFAULT_CONCURRENCY} {
+		client := RPCClient{Concurrency: concurrency}
+		budget := NewBlockBudget(TransferBudget(client))
+		workers := concurrency
+		if workers < 1 {
+			workers = 1
+		}
+		// every worker transferring a file holds a window, none waits
+		acquired := make(chan int, workers)
+		for i := 0; i < workers; i++ {
+			go func() { acquired <- budget.Acquire(TransferWindow(client)) }()
+		}
+		for i := 0; i < workers; i++ {
+			select {
+			case reserved := <-acquired:
+				if reserved != TransferWindow(client) || reserved < 1 {
+					t.Errorf("concurrency %d: reserved %d blocks, want a window of %d", concurrency, reserved, TransferWindow(client))
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("concurrency %d: %d of %d windows of %d blocks fit in a budget of %d", concurrency, i, workers, TransferWindow(client), TransferBudget(client))
+			}
+		}
+	}
+}
+
+func TestSyncBetweenClients(t *testing.T) {
+	addr := startTestServer(t)
+	a, b := newTestClient(t, addr), newTestClient(t, addr)
+	checkFiles := func(client RPCClient, want map[string]string) {
+		t.Helper()
+		files, err := os.ReadDir(client.BaseDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, file := range files {
+			if file.Name() == DEFAULT_META_FILENAME || file.Name() == DEFAULT_JOURNAL_FILENAME {
+				continue
+			}
+			content, err := os.ReadFile(filepath.Join(client.BaseDir, file.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[file.Name()] = string(content)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("files %v, want %v", got, want)
+		}
+	}
+
+	writeTestFiles(t, a, map[string]string{"x": "first x", "y": "first y", "z": "first z"})
+	if report := testSync(t, a); report.Uploaded != 3 {
+		t.Errorf("%d files uploaded, want x, y and z", report.Uploaded)
+	}
+	if report := testSync(t, b); report.Downloaded != 3 {
+		t.Errorf("%d files downloaded, want x, y and z", report.Downloaded)
+	}
+	checkFiles(b, map[string]string{"x": "first x", "y": "first y", "z": "first z"})
+
+	writeTestFiles(t, a, map[string]string{"x": "second x"})
+	if err := os.Remove(filepath.Join(a.BaseDir, "y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(a.BaseDir, "z"), filepath.Join(a.BaseDir, "w")); err != nil {
+		t.Fatal(err)
+	}
+	if report := testSync(t, a); report.Uploaded != 1 || report.DeletedRemotely != 1 || report.Renamed != 1 {
+		t.Errorf("uploaded %d, deleted %d, renamed %d, want 1 each", report.Uploaded, report.DeletedRemotely, report.Renamed)
+	}
+	if report := testSync(t, b); report.Downloaded != 1 || report.DeletedLocally != 1 || report.Renamed != 1 {
+		t.Errorf("downloaded %d, deleted %d, renamed %d, want 1 each", report.Downloaded, report.DeletedLocally, report.Renamed)
+	}
+	checkFiles(b, map[string]string{"x": "second x", "w": "first z"})
+	if report := testSync(t, a); len(report.Files) != 0 {
+		t.Errorf("files synced again: %v", report.Files)
+	}
+
+	// a sync stopped before it starts transfers nothing
+	writeTestFiles(t, a, map[string]string{"v": "not uploaded"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Sync(ctx, SyncOptions{Client: a}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Sync with a canceled context = %v, want %v", err, context.Canceled)
+	}
+	var remote_FileInfoMap map[string]*FileMetaData
+	if err := a.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := remote_FileInfoMap["v"]; ok {
+		t.Errorf("v uploaded by a stopped sync")
+	}
+	testSync(t, a)
+	testSync(t, b)
+	checkFiles(b, map[string]string{"x": "second x", "w": "first z", "v": "not uploaded"})
+}
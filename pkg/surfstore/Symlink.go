@@ -0,0 +1,64 @@
+package surfstore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Symlink Related
+*/
+
+// NewLinkStat returns the stat data of the symlink at path, from its Lstat
+// info, with its target.
+func NewLinkStat(path string, info os.FileInfo) (*FileStat, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return nil, err
+	}
+	local_stat := NewFileStat(info)
+	local_stat.LinkTarget = filepath.ToSlash(target)
+	return local_stat, nil
+}
+
+// LinkHashlist returns the hash list of a symlink, the blocks of its target.
+func LinkHashlist(target string, blockSize int) []string {
+	hashlist, _, _, _ := HashReader(strings.NewReader(target), blockSize)
+	return hashlist
+}
+
+// IsSymlinkOutside reports whether a symlink of the base directory with the
+// given target points outside of it.
+func IsSymlinkOutside(target string) bool {
+	if strings.HasPrefix(target, "/") || filepath.IsAbs(filepath.FromSlash(target)) {
+		return true
+	}
+	cleaned := filepath.ToSlash(filepath.Clean(filepath.FromSlash(target)))
+	return cleaned == ".." || strings.HasPrefix(cleaned, "../")
+}
+
+// CreateSymlink replaces the file at path with a symlink to target. Like
+// AtomicFile, the link is created under a temporary name then renamed.
+func CreateSymlink(target string, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), TMP_FILE_PREFIX)
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+	f.Close()
+	os.Remove(tempPath)
+	if err := os.Symlink(filepath.FromSlash(target), tempPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// isSymlink reports whether fileMetaData describes a symlink.
+func isSymlink(fileMetaData *FileMetaData) bool {
+	return fileMetaData.Type == FileType_SYMLINK
+}
@@ -0,0 +1,125 @@
+package surfstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncSymlinkPolicies(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// how a synced file is found on the server and in a base directory
+	const (
+		absent  = ""
+		link    = "link"
+		regular = "regular"
+	)
+	tests := []struct {
+		policy  string
+		outside string // the local link to a file outside the base directory
+		kept    string // the remote link to it, synced by another client
+	}{
+		{SYMLINK_POLICY_SKIP, absent, absent},
+		{SYMLINK_POLICY_KEEP, link, link},
+		{SYMLINK_POLICY_FOLLOW, regular, absent},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			addr := startTestServer(t)
+			keeper, client, receiver := newTestClient(t, addr), newTestClient(t, addr), newTestClient(t, addr)
+			keeper.SymlinkPolicy = SYMLINK_POLICY_KEEP
+			client.SymlinkPolicy = test.policy
+			receiver.SymlinkPolicy = test.policy
+			symlink := func(client RPCClient, target string, filename string) {
+				if err := os.Symlink(target, filepath.Join(client.BaseDir, filename)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			symlink(keeper, outside, "kept")
+			testSync(t, keeper)
+			writeTestFiles(t, client, map[string]string{"target.txt": "content"})
+			symlink(client, "target.txt", "inside")
+			symlink(client, outside, "outside")
+			report := testSync(t, client)
+			testSync(t, receiver)
+			skipped := make(map[string]bool)
+			for _, result := range report.Files {
+				if result.Action == SYNC_ACTION_SKIP {
+					skipped[result.Filename] = true
+				}
+			}
+			if skipped["outside"] != (test.policy == SYMLINK_POLICY_SKIP) || skipped["kept"] != (test.kept == absent) {
+				t.Errorf("skipped %v", skipped)
+			}
+
+			var remote_FileInfoMap map[string]*FileMetaData
+			if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+				t.Fatal(err)
+			}
+			remote := func(filename string) string {
+				if remote_meta_data, ok := remote_FileInfoMap[filename]; !ok || IsDeleted(remote_meta_data) {
+					return absent
+				} else if isSymlink(remote_meta_data) {
+					return link
+				}
+				return regular
+			}
+			local := func(client RPCClient, filename string) string {
+				info, err := os.Lstat(filepath.Join(client.BaseDir, filename))
+				if os.IsNotExist(err) {
+					return absent
+				} else if err != nil {
+					t.Fatal(err)
+				} else if info.Mode()&os.ModeSymlink != 0 {
+					return link
+				}
+				return regular
+			}
+
+			if got := remote("inside"); got != link {
+				t.Errorf("link inside the base directory on the server: %q, want %q", got, link)
+			}
+			if got := remote("kept"); got != link {
+				t.Errorf("link synced by the keep policy removed from the server: %q", got)
+			}
+			if got := remote("outside"); got != test.outside {
+				t.Errorf("link outside the base directory on the server: %q, want %q", got, test.outside)
+			}
+			for _, c := range []RPCClient{client, receiver} {
+				if got := local(c, "kept"); got != test.kept {
+					t.Errorf("link synced by the keep policy in %s: %q, want %q", c.BaseDir, got, test.kept)
+				}
+			}
+			if got := local(receiver, "outside"); got != test.outside {
+				t.Errorf("link outside the base directory received as %q, want %q", got, test.outside)
+			}
+			if target, err := os.Readlink(filepath.Join(receiver.BaseDir, "inside")); err != nil || target != "target.txt" {
+				t.Errorf("link inside the base directory received pointing to %q, %v", target, err)
+			}
+			if test.outside == link {
+				if target, err := os.Readlink(filepath.Join(receiver.BaseDir, "outside")); err != nil || target != outside {
+					t.Errorf("kept link received pointing to %q, %v, want %s", target, err, outside)
+				}
+			} else if test.outside == regular {
+				if content, err := os.ReadFile(filepath.Join(receiver.BaseDir, "outside")); err != nil || string(content) != "secret" {
+					t.Errorf("followed link received as %q, %v, want the content it points to", content, err)
+				}
+			}
+			// the local link is never replaced
+			if got := local(client, "outside"); got != link {
+				t.Errorf("local link to a file outside the base directory is now %q", got)
+			}
+
+			for _, c := range []RPCClient{client, receiver} {
+				for _, result := range testSync(t, c).Files {
+					if result.Action != SYNC_ACTION_SKIP {
+						t.Errorf("second sync of %s: %s of %s", c.BaseDir, result.Action, result.Filename)
+					}
+				}
+			}
+		})
+	}
+}
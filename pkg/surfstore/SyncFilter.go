@@ -0,0 +1,238 @@
+package surfstore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SyncFilter selects the files of the base directory and of the server a
+// client syncs. A file left out is neither uploaded, downloaded nor deleted,
+// on either side.
+type SyncFilter struct {
+	ignore  *IgnoreRules // files never synced, from .surfignore
+	include *IgnoreRules // the only files synced, from .surfinclude, nil to sync every file
+
+	symlinkPolicy string          // what to do with symlinks pointing outside the base directory
+	skippedLinks  map[string]bool // local symlinks left out by the policy, found by the scan
+
+	// left out so far, on either side: symlinks by the policy, and files and
+	// directories by the patterns
+	linksSkipped map[string]bool
+	filtered     map[string]bool
+}
+
+// LoadSyncFilter reads the .surfignore and .surfinclude files of the client's
+// base directory. Both are optional.
+func LoadSyncFilter(client RPCClient) (*SyncFilter, error) {
+	baseDir := client.BaseDir
+	ignore, err := LoadIgnoreRules(ConcatPath(baseDir, IGNORE_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	include, err := LoadIgnoreRules(ConcatPath(baseDir, INCLUDE_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	if len(include.patterns) == 0 {
+		include = nil
+	}
+	return &SyncFilter{ignore: ignore, include: include, symlinkPolicy: client.SymlinkPolicy, skippedLinks: make(map[string]bool), linksSkipped: make(map[string]bool), filtered: make(map[string]bool)}, nil
+}
+
+// Excluded reports whether the file (or directory) at the given path,
+// relative to the base directory, is left out of the sync.
+func (f *SyncFilter) Excluded(name string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	if f.skippedLinks[name] {
+		f.linksSkipped[name] = true
+		return true
+	}
+	if f.matched(name, isDir) {
+		f.filtered[name] = true
+		return true
+	}
+	return false
+}
+
+// matched reports whether the patterns leave out the file (or directory) at
+// the given path, without counting it as filtered.
+func (f *SyncFilter) matched(name string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	// a directory may contain files to include
+	return f.ignore.Match(name, isDir) || (f.include != nil && !isDir && !f.include.Match(name, isDir))
+}
+
+// SkippedLinks returns the symlinks left out by the symlink policy so far,
+// on either side, sorted.
+func (f *SyncFilter) SkippedLinks() []string {
+	names := make([]string, 0)
+	if f == nil {
+		return names
+	}
+	for name := range f.linksSkipped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FilteredCount returns the number of files and directories left out by
+// the patterns so far, on either side.
+func (f *SyncFilter) FilteredCount() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.filtered)
+}
+
+// skipLink leaves out a local symlink, and the file of the same name on the
+// server, which would otherwise be deleted or overwrite the link.
+func (f *SyncFilter) skipLink(name string) {
+	if f != nil {
+		f.skippedLinks[name] = true
+		f.linksSkipped[name] = true
+	}
+}
+
+// FilterMetaMap returns the entries of fileMetas that are synced. Symlinks
+// pointing outside the base directory are only synced with the keep policy.
+func (f *SyncFilter) FilterMetaMap(fileMetas map[string]*FileMetaData) map[string]*FileMetaData {
+	filtered := make(map[string]*FileMetaData, len(fileMetas))
+	for filename, fileMeta := range fileMetas {
+		outside_link := isSymlink(fileMeta) && IsSymlinkOutside(fileMeta.LinkTarget)
+		if f != nil && outside_link && f.symlinkPolicy != SYMLINK_POLICY_KEEP {
+			f.linksSkipped[filename] = true
+			continue
+		}
+		if !f.Excluded(filename, false) {
+			filtered[filename] = fileMeta
+		}
+	}
+	return filtered
+}
+
+/*
+	Ignore Patterns
+*/
+
+// IgnoreRules is a list of gitignore-style patterns:
+//   - blank lines and lines starting with "#" are skipped
+//   - "*", "?" and "[...]" match within a path component, "**" matches any
+//     number of components
+//   - a pattern containing a "/" (other than a trailing one) is matched from
+//     the base directory, otherwise it matches a name at any depth
+//   - a trailing "/" only matches directories, and the files inside them
+//   - a leading "!" re-includes a path excluded by a previous pattern
+//
+// The last pattern matching a path decides whether it matches.
+type IgnoreRules struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	segments []string // the pattern split on "/"
+	negate   bool
+	dirOnly  bool
+}
+
+// LoadIgnoreRules parses the patterns of the file at filePath. A missing
+// file has no pattern.
+func LoadIgnoreRules(filePath string) (*IgnoreRules, error) {
+	content, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return &IgnoreRules{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rules, err := ParseIgnoreRules(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return rules, nil
+}
+
+// ParseIgnoreRules parses one pattern per line.
+func ParseIgnoreRules(content string) (*IgnoreRules, error) {
+	rules := &IgnoreRules{}
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var pattern ignorePattern
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		pattern.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		for _, segment := range pattern.segments {
+			if _, err := path.Match(segment, ""); err != nil || segment == "" {
+				return nil, fmt.Errorf("line %d: invalid pattern %q", i+1, line)
+			}
+		}
+		rules.patterns = append(rules.patterns, pattern)
+	}
+	return rules, nil
+}
+
+// Match reports whether the file (or directory) at the given slash-separated
+// path is matched by the rules. A path inside a matched directory is matched.
+func (r *IgnoreRules) Match(name string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	segments := strings.Split(name, "/")
+	for i := 1; i < len(segments); i++ {
+		if r.matchPath(segments[:i], true) {
+			return true
+		}
+	}
+	return r.matchPath(segments, isDir)
+}
+
+func (r *IgnoreRules) matchPath(segments []string, isDir bool) bool {
+	matched := false
+	for _, pattern := range r.patterns {
+		if (isDir || !pattern.dirOnly) && matchSegments(pattern.segments, segments) {
+			matched = !pattern.negate
+		}
+	}
+	return matched
+}
+
+// matchSegments matches a path against a pattern, one component at a time.
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchSegments(pattern[1:], segments[1:])
+}
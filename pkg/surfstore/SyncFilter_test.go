@@ -0,0 +1,58 @@
+package surfstore
+
+import (
+	"testing"
+)
+
+func TestIgnoreRulesMatch(t *testing.T) {
+	tests := []struct {
+		patterns string
+		name     string
+		isDir    bool
+		match    bool
+	}{
+		{"", "a.txt", false, false},
+		{"# comment\n\n", "# comment", false, false},
+		{"*.log", "debug.log", false, true},
+		{"*.log", "debug.log.txt", false, false},
+		{"*.log", "logs/debug.log", false, true},
+		{"debug?.log", "debug1.log", false, true},
+		{"debug?.log", "debug10.log", false, false},
+		{"[ab].txt", "b.txt", false, true},
+		{"[ab].txt", "c.txt", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "build/out.o", false, true},
+		{"build/", "src/build/out.o", false, true},
+		{"/build", "build", false, true},
+		{"/build", "src/build", false, false},
+		{"docs/*.md", "docs/a.md", false, true},
+		{"docs/*.md", "docs/sub/a.md", false, false},
+		{"docs/**/*.md", "docs/sub/deep/a.md", false, true},
+		{"docs/**/*.md", "docs/a.md", false, true},
+		{"**/tmp", "a/b/tmp", true, true},
+		{"*.log\n!keep.log", "keep.log", false, false},
+		{"*.log\n!keep.log", "other.log", false, true},
+		{"!keep.log\n*.log", "keep.log", false, true},
+		{"\\#notes", "#notes", false, true},
+		{"\\!important", "!important", false, true},
+		{"trailing.txt  ", "trailing.txt", false, true},
+	}
+	for _, test := range tests {
+		rules, err := ParseIgnoreRules(test.patterns)
+		if err != nil {
+			t.Fatalf("ParseIgnoreRules(%q): %v", test.patterns, err)
+		}
+		if match := rules.Match(test.name, test.isDir); match != test.match {
+			t.Errorf("%q matching %q (dir: %v) = %v, want %v", test.patterns, test.name, test.isDir, match, test.match)
+		}
+	}
+}
+
+func TestParseIgnoreRulesInvalid(t *testing.T) {
+	for _, patterns := range []string{"[a", "a//b", "ok\nbad[\n"} {
+		if _, err := ParseIgnoreRules(patterns); err == nil {
+			t.Errorf("ParseIgnoreRules(%q) succeeded, want an error", patterns)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package surfstore
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SyncPlan is what a sync does, decided from the local files, the local index
+// and the FileInfoMap of the server. Every list is sorted by filename.
+type SyncPlan struct {
+	Added     []string        // files created locally since the last sync
+	Modified  []string        // files modified locally since the last sync
+	Deleted   []string        // files deleted locally since the last sync
+	Downloads []*FileMetaData // remote versions applied locally, a tombstone deletes the local file
+	Uploads   []*FileMetaData // local versions sent to the server, a tombstone deletes the remote file
+	Unchanged []*FileMetaData // files already in sync, only recorded in the local index
+	Conflicts []string        // files modified both locally and remotely, the remote version wins
+
+	Renames       []*FileRename // local renames sent to the server with RenameFile, sorted by new name
+	RemoteRenames []*FileRename // renames done on the server, applied by renaming the local file
+
+	// remote files left out of Downloads because their name differs only in
+	// case from another file of a case-insensitive base directory
+	CaseCollisions []*CaseCollision
+}
+
+// PlanSync compares the local files (local_FileInfoMap, as returned by
+// GitAdd) with the local index and the server.
+func PlanSync(local_FileInfoMap map[string]*FileMetaData, committed_FileInfoMap map[string]*FileMetaData, remote_FileInfoMap map[string]*FileMetaData) *SyncPlan {
+	plan := &SyncPlan{
+		Added:     make([]string, 0),
+		Modified:  make([]string, 0),
+		Deleted:   make([]string, 0),
+		Downloads: make([]*FileMetaData, 0),
+		Uploads:   make([]*FileMetaData, 0),
+		Unchanged: make([]*FileMetaData, 0),
+		Conflicts: make([]string, 0),
+
+		Renames:       make([]*FileRename, 0),
+		RemoteRenames: make([]*FileRename, 0),
+
+		CaseCollisions: make([]*CaseCollision, 0),
+	}
+
+	// GitAdd bumps the version of the files changed locally
+	locally_changed := make(map[string]bool)
+	for filename, local_meta_data := range local_FileInfoMap {
+		committed_meta_data, ok := committed_FileInfoMap[filename]
+		if ok && committed_meta_data.Version == local_meta_data.Version {
+			continue
+		}
+		locally_changed[filename] = true
+		if IsDeleted(local_meta_data) {
+			plan.Deleted = append(plan.Deleted, filename)
+		} else if !ok || IsDeleted(committed_meta_data) {
+			plan.Added = append(plan.Added, filename)
+		} else {
+			plan.Modified = append(plan.Modified, filename)
+		}
+	}
+
+	// (1) download (pull)
+	for filename, remote_meta_data := range remote_FileInfoMap {
+		map_value, ok := local_FileInfoMap[filename]
+		if !ok || remote_meta_data.Version > map_value.Version || (remote_meta_data.Version == map_value.Version && !CompareHashlist(map_value.BlockHashList, remote_meta_data.BlockHashList)) {
+			// the second case is a race condition
+			// someone update the server, and I upload the local, now the local file and the remote file have the same version, but different content
+			plan.Downloads = append(plan.Downloads, remote_meta_data)
+			if locally_changed[filename] {
+				plan.Conflicts = append(plan.Conflicts, filename)
+			}
+		} else if remote_meta_data.Version == map_value.Version {
+			// already in sync
+			plan.Unchanged = append(plan.Unchanged, remote_meta_data)
+		}
+	}
+
+	// (2) upload (push)
+	for filename, local_meta_data := range local_FileInfoMap {
+		map_value, ok := remote_FileInfoMap[filename]
+		if !ok || (local_meta_data.Version == map_value.Version+1) {
+			plan.Uploads = append(plan.Uploads, local_meta_data)
+		} else if local_meta_data.Version > map_value.Version+1 {
+			log.Println("Local version is larger than 1 compared than remote version, which is imp!", filename)
+		}
+	}
+
+	sort.Strings(plan.Added)
+	sort.Strings(plan.Modified)
+	sort.Strings(plan.Deleted)
+	sortMetaList(plan.Downloads)
+	sortMetaList(plan.Uploads)
+	sortMetaList(plan.Unchanged)
+	sort.Strings(plan.Conflicts)
+
+	// (3) renames, instead of a deletion and a transfer of the same content
+	planRenames(plan, committed_FileInfoMap)
+	planRemoteRenames(plan, local_FileInfoMap, committed_FileInfoMap, locally_changed)
+	planNormalizedNames(plan, local_FileInfoMap)
+	return plan
+}
+
+// planRenames pairs the uploads of a locally deleted file and of an added
+// file with the same content into a rename.
+func planRenames(plan *SyncPlan, committed_FileInfoMap map[string]*FileMetaData) {
+	added := make(map[string]bool)
+	for _, filename := range plan.Added {
+		added[filename] = true
+	}
+	deleted_by_content := make(map[string][]*FileMetaData)
+	for _, local_meta_data := range plan.Uploads {
+		committed_meta_data, ok := committed_FileInfoMap[local_meta_data.Filename]
+		if IsDeleted(local_meta_data) && ok && isRenameable(committed_meta_data) {
+			key := strings.Join(committed_meta_data.BlockHashList, HASH_DELIMITER)
+			deleted_by_content[key] = append(deleted_by_content[key], local_meta_data)
+		}
+	}
+
+	renamed := make(map[string]bool)
+	for _, local_meta_data := range plan.Uploads {
+		if !added[local_meta_data.Filename] || !isRenameable(local_meta_data) {
+			continue
+		}
+		key := strings.Join(local_meta_data.BlockHashList, HASH_DELIMITER)
+		if candidates := deleted_by_content[key]; len(candidates) > 0 {
+			deleted_by_content[key] = candidates[1:]
+			plan.Renames = append(plan.Renames, &FileRename{From: candidates[0], To: local_meta_data})
+			renamed[candidates[0].Filename] = true
+			renamed[local_meta_data.Filename] = true
+		}
+	}
+	plan.Uploads = withoutFiles(plan.Uploads, renamed)
+}
+
+// planRemoteRenames turns the downloads of a version created by RenameFile
+// and of the deletion of the file it was renamed from into a local rename,
+// as long as neither file was changed locally.
+func planRemoteRenames(plan *SyncPlan, local_FileInfoMap map[string]*FileMetaData, committed_FileInfoMap map[string]*FileMetaData, locally_changed map[string]bool) {
+	deletions := make(map[string]*FileMetaData)
+	for _, remote_meta_data := range plan.Downloads {
+		if IsDeleted(remote_meta_data) {
+			deletions[remote_meta_data.Filename] = remote_meta_data
+		}
+	}
+
+	renamed := make(map[string]bool)
+	for _, remote_meta_data := range plan.Downloads {
+		from, ok := deletions[remote_meta_data.RenamedFrom]
+		if !ok || IsDeleted(remote_meta_data) || renamed[from.Filename] || locally_changed[from.Filename] || locally_changed[remote_meta_data.Filename] {
+			continue
+		}
+		committed_meta_data, ok := committed_FileInfoMap[from.Filename]
+		if !ok || !isRenameable(committed_meta_data) || !CompareHashlist(committed_meta_data.BlockHashList, remote_meta_data.BlockHashList) {
+			continue
+		}
+		if local_meta_data, ok := local_FileInfoMap[remote_meta_data.Filename]; ok && !IsDeleted(local_meta_data) {
+			// the rename would overwrite it
+			continue
+		}
+		plan.RemoteRenames = append(plan.RemoteRenames, &FileRename{From: from, To: remote_meta_data})
+		renamed[from.Filename] = true
+		renamed[remote_meta_data.Filename] = true
+	}
+	plan.Downloads = withoutFiles(plan.Downloads, renamed)
+}
+
+// isRenameable reports whether a rename of the file is worth detecting. Many
+// empty files share the same (empty) content, and symlinks are cheap to
+// recreate.
+func isRenameable(fileMetaData *FileMetaData) bool {
+	return !IsDeleted(fileMetaData) && !isSymlink(fileMetaData) && len(fileMetaData.BlockHashList) > 0
+}
+
+func withoutFiles(fileMetaDatas []*FileMetaData, filenames map[string]bool) []*FileMetaData {
+	kept := make([]*FileMetaData, 0, len(fileMetaDatas))
+	for _, fileMetaData := range fileMetaDatas {
+		if !filenames[fileMetaData.Filename] {
+			kept = append(kept, fileMetaData)
+		}
+	}
+	return kept
+}
+
+// PlanClientSync computes the plan of a sync of the client's base directory,
+// without writing to the base directory or the server.
+func PlanClientSync(client RPCClient) (*SyncPlan, error) {
+	committed_FileInfoMap, committed_FileStats, err := LoadLocalIndexReadOnly(client)
+	if err != nil {
+		return nil, fmt.Errorf("load local index: %w", err)
+	}
+	sync_filter, err := LoadSyncFilter(client)
+	if err != nil {
+		return nil, fmt.Errorf("load sync filter: %w", err)
+	}
+	local_Filehashlists, local_FileStats, err := ComputeFileHashlist(client, committed_FileInfoMap, committed_FileStats, nil, sync_filter)
+	if err != nil {
+		return nil, err
+	}
+	committed_FileInfoMap = sync_filter.FilterMetaMap(committed_FileInfoMap)
+	local_FileInfoMap, err := GitAdd(client, local_Filehashlists, local_FileStats, committed_FileInfoMap)
+	if err != nil {
+		return nil, err
+	}
+
+	var remote_FileInfoMap map[string]*FileMetaData
+	err = client.GetFileInfoMap(&remote_FileInfoMap)
+	if err != nil {
+		return nil, fmt.Errorf("get file info map: %w", err)
+	}
+	remote_FileInfoMap = sync_filter.FilterMetaMap(remote_FileInfoMap)
+	plan := PlanSync(local_FileInfoMap, committed_FileInfoMap, remote_FileInfoMap)
+	if isCaseInsensitiveDir(client.BaseDir) {
+		planCaseCollisions(plan, local_FileInfoMap)
+	}
+	return plan, nil
+}
+
+// LoadLocalIndexReadOnly returns the entries of the client's local index
+// like OpenLocalIndex and Load, but never creates or modifies the index.
+func LoadLocalIndexReadOnly(client RPCClient) (map[string]*FileMetaData, map[string]*FileStat, error) {
+	metaFilePath := ConcatPath(client.BaseDir, DEFAULT_META_FILENAME)
+	switch client.IndexType {
+	case "", INDEX_TYPE_TEXT:
+		fileMetas, fileStats, _, err := loadTextIndex(metaFilePath)
+		return fileMetas, fileStats, err
+	case INDEX_TYPE_BOLT:
+		dbPath := ConcatPath(client.BaseDir, DEFAULT_META_DB_FILENAME)
+		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+			// a new database would be seeded from the text index
+			fileMetas, fileStats, _, err := loadTextIndex(metaFilePath)
+			return fileMetas, fileStats, err
+		}
+		db, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: DB_LOCK_TIMEOUT, ReadOnly: true})
+		if err != nil {
+			return nil, nil, err
+		}
+		defer db.Close()
+		return (&BoltLocalIndex{db: db}).Load()
+	default:
+		return nil, nil, fmt.Errorf("unknown index type %q", client.IndexType)
+	}
+}
+
+// PrintSyncPlan prints the transfers and deletions a sync would do to w.
+func PrintSyncPlan(w io.Writer, plan *SyncPlan) {
+	if len(plan.Downloads)+len(plan.Uploads)+len(plan.Renames)+len(plan.RemoteRenames)+len(plan.CaseCollisions) == 0 {
+		fmt.Fprintln(w, "Everything up to date")
+		return
+	}
+	conflicts := make(map[string]bool)
+	for _, filename := range plan.Conflicts {
+		conflicts[filename] = true
+	}
+	for _, collision := range plan.CaseCollisions {
+		fmt.Fprintf(w, "  case collision: %s (version %d) differs only in case from %s\n", collision.File.Filename, collision.File.Version, collision.CollidesWith)
+	}
+	for _, fileRename := range plan.RemoteRenames {
+		fmt.Fprintf(w, "  rename locally: %s -> %s (version %d)\n", fileRename.From.Filename, fileRename.To.Filename, fileRename.To.Version)
+	}
+	for _, fileMetaData := range plan.Downloads {
+		action := "download"
+		if IsDeleted(fileMetaData) {
+			action = "delete locally"
+		}
+		if conflicts[fileMetaData.Filename] {
+			action += " (conflict, local changes are lost)"
+		}
+		fmt.Fprintf(w, "  %s: %s (version %d)\n", action, fileMetaData.Filename, fileMetaData.Version)
+	}
+	for _, fileMetaData := range plan.Uploads {
+		action := "upload"
+		if IsDeleted(fileMetaData) {
+			action = "delete remotely"
+		}
+		fmt.Fprintf(w, "  %s: %s (version %d)\n", action, fileMetaData.Filename, fileMetaData.Version)
+	}
+	for _, fileRename := range plan.Renames {
+		fmt.Fprintf(w, "  rename remotely: %s -> %s (version %d)\n", fileRename.From.Filename, fileRename.To.Filename, fileRename.To.Version)
+	}
+}
+
+// PrintStatus prints the local changes since the last sync to w, then the
+// plan of the next sync.
+func PrintStatus(w io.Writer, plan *SyncPlan) {
+	fmt.Fprintln(w, "Local changes:")
+	if len(plan.Added)+len(plan.Modified)+len(plan.Deleted) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, filename := range plan.Added {
+		fmt.Fprintf(w, "  added: %s\n", filename)
+	}
+	for _, filename := range plan.Modified {
+		fmt.Fprintf(w, "  modified: %s\n", filename)
+	}
+	for _, filename := range plan.Deleted {
+		fmt.Fprintf(w, "  deleted: %s\n", filename)
+	}
+	fmt.Fprintln(w, "Sync plan:")
+	PrintSyncPlan(w, plan)
+}
+
+func sortMetaList(fileMetaDatas []*FileMetaData) {
+	sort.Slice(fileMetaDatas, func(i, j int) bool {
+		return fileMetaDatas[i].Filename < fileMetaDatas[j].Filename
+	})
+}
@@ -0,0 +1,191 @@
+package surfstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// plannedFiles is a SyncPlan reduced to filenames, a rename is "from -> to".
+type plannedFiles struct {
+	Added, Modified, Deleted          []string
+	Downloads, Uploads, Unchanged     []string
+	Conflicts, Renames, RemoteRenames []string
+}
+
+func newPlannedFiles(plan *SyncPlan) plannedFiles {
+	filenames := func(fileMetaDatas []*FileMetaData) []string {
+		names := make([]string, 0)
+		for _, fileMetaData := range fileMetaDatas {
+			names = append(names, fileMetaData.Filename)
+		}
+		return names
+	}
+	renames := func(fileRenames []*FileRename) []string {
+		names := make([]string, 0)
+		for _, fileRename := range fileRenames {
+			names = append(names, fileRename.From.Filename+" -> "+fileRename.To.Filename)
+		}
+		return names
+	}
+	return plannedFiles{
+		Added:         plan.Added,
+		Modified:      plan.Modified,
+		Deleted:       plan.Deleted,
+		Downloads:     filenames(plan.Downloads),
+		Uploads:       filenames(plan.Uploads),
+		Unchanged:     filenames(plan.Unchanged),
+		Conflicts:     plan.Conflicts,
+		Renames:       renames(plan.Renames),
+		RemoteRenames: renames(plan.RemoteRenames),
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	meta := func(filename string, version int32, hash string) *FileMetaData {
+		return &FileMetaData{Filename: filename, Version: version, BlockHashList: []string{hash}}
+	}
+	renamed := meta("b", 1, hashA)
+	renamed.RenamedFrom = "a"
+	none := []string{}
+
+	tests := []struct {
+		name      string
+		local     []*FileMetaData
+		committed []*FileMetaData
+		remote    []*FileMetaData
+		want      plannedFiles
+	}{
+		{
+			"in sync",
+			[]*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{meta("a", 1, hashA)},
+			plannedFiles{none, none, none, none, none, []string{"a"}, none, none, none},
+		},
+		{
+			"added",
+			[]*FileMetaData{meta("a", 1, hashA)}, nil, nil,
+			plannedFiles{[]string{"a"}, none, none, none, []string{"a"}, none, none, none, none},
+		},
+		{
+			"modified",
+			[]*FileMetaData{meta("a", 2, hashB)}, []*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{meta("a", 1, hashA)},
+			plannedFiles{none, []string{"a"}, none, none, []string{"a"}, none, none, none, none},
+		},
+		{
+			"deleted",
+			[]*FileMetaData{NewTombstone("a", 2)}, []*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{meta("a", 1, hashA)},
+			plannedFiles{none, none, []string{"a"}, none, []string{"a"}, none, none, none, none},
+		},
+		{
+			"changed remotely",
+			[]*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{meta("a", 2, hashB)},
+			plannedFiles{none, none, none, []string{"a"}, none, none, none, none, none},
+		},
+		{
+			"added remotely",
+			nil, nil, []*FileMetaData{meta("a", 1, hashA)},
+			plannedFiles{none, none, none, []string{"a"}, none, none, none, none, none},
+		},
+		{
+			"changed on both sides",
+			[]*FileMetaData{meta("a", 2, hashB)}, []*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{meta("a", 2, hashA)},
+			plannedFiles{none, []string{"a"}, none, []string{"a"}, none, none, []string{"a"}, none, none},
+		},
+		{
+			"renamed",
+			[]*FileMetaData{NewTombstone("a", 2), meta("b", 1, hashA)}, []*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{meta("a", 1, hashA)},
+			plannedFiles{[]string{"b"}, none, []string{"a"}, none, none, none, none, []string{"a -> b"}, none},
+		},
+		{
+			"renamed remotely",
+			[]*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{NewTombstone("a", 2), renamed},
+			plannedFiles{none, none, none, none, none, none, none, none, []string{"a -> b"}},
+		},
+		{
+			"renamed remotely and changed locally",
+			[]*FileMetaData{meta("a", 2, hashB)}, []*FileMetaData{meta("a", 1, hashA)}, []*FileMetaData{NewTombstone("a", 2), renamed},
+			plannedFiles{none, []string{"a"}, none, []string{"a", "b"}, none, none, []string{"a"}, none, none},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			toMap := func(fileMetaDatas []*FileMetaData) map[string]*FileMetaData {
+				fileMetaMap := make(map[string]*FileMetaData)
+				for _, fileMetaData := range fileMetaDatas {
+					fileMetaMap[fileMetaData.Filename] = fileMetaData
+				}
+				return fileMetaMap
+			}
+			plan := PlanSync(toMap(test.local), toMap(test.committed), toMap(test.remote))
+			if got := newPlannedFiles(plan); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("PlanSync() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlanClientSync(t *testing.T) {
+	addr := startTestServer(t)
+	other := newTestClient(t, addr)
+	writeTestFiles(t, other, map[string]string{"remote": "from the server", "both": "same"})
+	testSync(t, other)
+
+	client := newTestClient(t, addr)
+	writeTestFiles(t, client, map[string]string{"local": "not uploaded yet", "both": "same"})
+	plan, err := PlanClientSync(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := plannedFiles{
+		Added:         []string{"both", "local"},
+		Modified:      []string{},
+		Deleted:       []string{},
+		Downloads:     []string{"remote"},
+		Uploads:       []string{"local"},
+		Unchanged:     []string{"both"}, // added with the same content on both sides
+		Conflicts:     []string{},
+		Renames:       []string{},
+		RemoteRenames: []string{},
+	}
+	if got := newPlannedFiles(plan); !reflect.DeepEqual(got, want) {
+		t.Errorf("PlanClientSync() = %+v, want %+v", got, want)
+	}
+
+	// planning writes nothing, locally or on the server
+	files, err := os.ReadDir(client.BaseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("base directory has %d files after planning, want local and both", len(files))
+	}
+	var remote_FileInfoMap map[string]*FileMetaData
+	if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := remote_FileInfoMap["local"]; ok {
+		t.Errorf("local uploaded by planning")
+	}
+
+	var status bytes.Buffer
+	PrintStatus(&status, plan)
+	for _, filename := range []string{"both", "local", "remote"} {
+		if !strings.Contains(status.String(), filename) {
+			t.Errorf("status doesn't mention %s:\n%s", filename, status.String())
+		}
+	}
+
+	// the plan is what the sync does
+	testSync(t, client)
+	for filename, want := range map[string]string{"local": "not uploaded yet", "remote": "from the server", "both": "same"} {
+		if content, err := os.ReadFile(filepath.Join(client.BaseDir, filename)); err != nil || string(content) != want {
+			t.Errorf("%s is %q, %v, want %q", filename, content, err, want)
+		}
+	}
+	if plan, err := PlanClientSync(client); err != nil || len(plan.Downloads)+len(plan.Uploads) != 0 {
+		t.Errorf("plan after the sync: %+v, %v, want nothing to transfer", newPlannedFiles(plan), err)
+	}
+}
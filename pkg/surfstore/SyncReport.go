@@ -0,0 +1,192 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Sync Report Related
+*/
+
+// SyncOptions configures Sync.
+type SyncOptions struct {
+	// the server address, base directory, block size and the other settings
+	// of the client
+	Client RPCClient
+	// progress messages for the user (resumed transfers, conflicts, renamed
+	// files), discarded if nil
+	Output io.Writer
+}
+
+// SyncReport is what a sync did. Files that failed are left as they were,
+// and retried by the next sync. The counts and transfer sizes are set once
+// Sync returns.
+type SyncReport struct {
+	Files []*FileResult `json:"files"` // in the order the files were synced
+
+	// files synced, by action, failed files aren't counted
+	Uploaded        int `json:"uploaded"`
+	Downloaded      int `json:"downloaded"`
+	DeletedLocally  int `json:"deletedLocally"`
+	DeletedRemotely int `json:"deletedRemotely"`
+	Renamed         int `json:"renamed"` // locally or remotely
+	Conflicted      int `json:"conflicted"`
+	Skipped         int `json:"skipped"`  // case collisions and symlinks left out by the policies
+	Filtered        int `json:"filtered"` // files and directories left out by .surfignore or .surfinclude
+	Failures        int `json:"failed"`   // files not synced, see Failed
+
+	// blocks sent to and fetched from the BlockStore, blocks already there
+	// or found locally aren't transferred
+	BlocksUploaded   int64 `json:"blocksUploaded"`
+	BytesUploaded    int64 `json:"bytesUploaded"`
+	BlocksDownloaded int64 `json:"blocksDownloaded"`
+	BytesDownloaded  int64 `json:"bytesDownloaded"`
+
+	Started      time.Time     `json:"started"`
+	ScanDuration time.Duration `json:"scanDurationNs"` // scanning the base directory and planning the sync
+	Duration     time.Duration `json:"durationNs"`
+}
+
+// FileResult is what a sync did to a file.
+type FileResult struct {
+	Filename string `json:"filename"`
+	Action   string `json:"action"`         // one of the SYNC_ACTION_* constants
+	Version  int32  `json:"version"`        // version of the file once synced
+	From     string `json:"from,omitempty"` // renames only, the previous name of the file
+	Err      error  `json:"-"`              // nil if the file was synced
+}
+
+// MarshalJSON adds the message of Err as "error".
+func (result *FileResult) MarshalJSON() ([]byte, error) {
+	type fileResult FileResult
+	var message string
+	if result.Err != nil {
+		message = result.Err.Error()
+	}
+	return json.Marshal(&struct {
+		*fileResult
+		Error string `json:"error,omitempty"`
+	}{(*fileResult)(result), message})
+}
+
+func (report *SyncReport) add(result *FileResult) {
+	report.Files = append(report.Files, result)
+}
+
+// finish sets the counts, the transfer sizes of stats and the duration.
+func (report *SyncReport) finish(stats *TransferStats) {
+	for _, result := range report.Files {
+		if result.Err != nil {
+			report.Failures++
+			continue
+		}
+		switch result.Action {
+		case SYNC_ACTION_UPLOAD:
+			report.Uploaded++
+		case SYNC_ACTION_DOWNLOAD:
+			report.Downloaded++
+		case SYNC_ACTION_DELETE_LOCAL:
+			report.DeletedLocally++
+		case SYNC_ACTION_DELETE_REMOTE:
+			report.DeletedRemotely++
+		case SYNC_ACTION_RENAME_LOCAL, SYNC_ACTION_RENAME_REMOTE:
+			report.Renamed++
+		case SYNC_ACTION_CONFLICT:
+			report.Conflicted++
+		case SYNC_ACTION_SKIP:
+			report.Skipped++
+		}
+	}
+	if stats != nil {
+		report.BlocksUploaded = atomic.LoadInt64(&stats.BlocksUploaded)
+		report.BytesUploaded = atomic.LoadInt64(&stats.BytesUploaded)
+		report.BlocksDownloaded = atomic.LoadInt64(&stats.BlocksDownloaded)
+		report.BytesDownloaded = atomic.LoadInt64(&stats.BytesDownloaded)
+	}
+	report.Duration = time.Since(report.Started)
+}
+
+// Failed returns the files the sync couldn't sync.
+func (report *SyncReport) Failed() []*FileResult {
+	failed := make([]*FileResult, 0)
+	for _, result := range report.Files {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// PrintSyncReport prints the counts and transfer sizes of a sync to w, then
+// what it did to every file.
+func PrintSyncReport(w io.Writer, report *SyncReport) {
+	fmt.Fprintf(w, "Synced in %v (scan %v)\n", report.Duration.Round(time.Millisecond), report.ScanDuration.Round(time.Millisecond))
+	fmt.Fprintf(w, "  uploaded: %d files, %d blocks (%d bytes) sent\n", report.Uploaded, report.BlocksUploaded, report.BytesUploaded)
+	fmt.Fprintf(w, "  downloaded: %d files, %d blocks (%d bytes) fetched\n", report.Downloaded, report.BlocksDownloaded, report.BytesDownloaded)
+	fmt.Fprintf(w, "  deleted: %d locally, %d remotely\n", report.DeletedLocally, report.DeletedRemotely)
+	fmt.Fprintf(w, "  renamed: %d\n", report.Renamed)
+	fmt.Fprintf(w, "  conflicted: %d\n", report.Conflicted)
+	fmt.Fprintf(w, "  skipped: %d\n", report.Skipped)
+	fmt.Fprintf(w, "  filtered: %d\n", report.Filtered)
+	fmt.Fprintf(w, "  failed: %d\n", report.Failures)
+	if len(report.Files) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Files:")
+	for _, result := range report.Files {
+		name := result.Filename
+		if result.From != "" {
+			name = result.From + " -> " + result.Filename
+		}
+		if result.Err != nil {
+			fmt.Fprintf(w, "  %s: %s (version %d) failed: %v\n", result.Action, name, result.Version, result.Err)
+		} else {
+			fmt.Fprintf(w, "  %s: %s (version %d)\n", result.Action, name, result.Version)
+		}
+	}
+}
+
+// TransferStats counts the blocks and bytes transferred by a sync. It is
+// safe for concurrent use, and a nil *TransferStats counts nothing.
+type TransferStats struct {
+	BlocksUploaded   int64
+	BytesUploaded    int64
+	BlocksDownloaded int64
+	BytesDownloaded  int64
+}
+
+func (stats *TransferStats) uploaded(bytes int) {
+	if stats == nil {
+		return
+	}
+	atomic.AddInt64(&stats.BlocksUploaded, 1)
+	atomic.AddInt64(&stats.BytesUploaded, int64(bytes))
+}
+
+func (stats *TransferStats) downloaded(bytes int) {
+	if stats == nil {
+		return
+	}
+	atomic.AddInt64(&stats.BlocksDownloaded, 1)
+	atomic.AddInt64(&stats.BytesDownloaded, int64(bytes))
+}
+
+// downloadAction returns the action of applying remote_meta_data locally.
+func downloadAction(remote_meta_data *FileMetaData) string {
+	if IsDeleted(remote_meta_data) {
+		return SYNC_ACTION_DELETE_LOCAL
+	}
+	return SYNC_ACTION_DOWNLOAD
+}
+
+// uploadAction returns the action of sending local_meta_data to the server.
+func uploadAction(local_meta_data *FileMetaData) string {
+	if IsDeleted(local_meta_data) {
+		return SYNC_ACTION_DELETE_REMOTE
+	}
+	return SYNC_ACTION_UPLOAD
+}
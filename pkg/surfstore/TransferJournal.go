@@ -0,0 +1,351 @@
+package surfstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TransferJournal persists the progress of the file transfers of a sync,
+// so that a sync interrupted in the middle of a huge file resumes where it
+// left off instead of starting over. It is an append-only log of
+// journalRecords in the base directory, one JSON object per line, replayed
+// when the journal is opened and removed once nothing is left in progress.
+type TransferJournal struct {
+	path      string
+	mutex     sync.Mutex
+	f         *os.File
+	transfers map[string]*journalRecord // transfers in progress, by filename
+	touched   map[string]bool           // files started or resumed by this sync
+}
+
+// journalRecord is one line of the journal. An upload or download record
+// starts a transfer, progress records update it, and a done record ends it.
+type journalRecord struct {
+	Op            string    `json:"op"`
+	Filename      string    `json:"file"`
+	Version       int32     `json:"version,omitempty"`
+	HashlistHash  string    `json:"hashlist_hash,omitempty"`
+	BlockHashList []string  `json:"hashes,omitempty"` // uploads only, so the file isn't rehashed when resuming
+	Stat          *FileStat `json:"stat,omitempty"`   // uploads only
+	TempFile      string    `json:"temp,omitempty"`   // downloads only
+	BlocksDone    int       `json:"blocks_done,omitempty"`
+	Offset        int64     `json:"offset,omitempty"` // downloads only, bytes of TempFile written
+}
+
+const (
+	journalOpUpload   = "upload"
+	journalOpDownload = "download"
+	journalOpProgress = "progress"
+	journalOpDone     = "done"
+)
+
+// OpenTransferJournal opens the journal of a base directory, replaying the
+// transfers left in progress by an interrupted sync.
+func OpenTransferJournal(baseDir string) (*TransferJournal, error) {
+	j := &TransferJournal{
+		path:      ConcatPath(baseDir, DEFAULT_JOURNAL_FILENAME),
+		transfers: make(map[string]*journalRecord),
+		touched:   make(map[string]bool),
+	}
+
+	if f, err := os.Open(j.path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1<<30)
+		for scanner.Scan() {
+			var record journalRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				// the last line may be torn by a crash, ignore it
+				continue
+			}
+			j.replay(&record)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// compact the log to the transfers still in progress
+	if err := j.rewrite(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *TransferJournal) replay(record *journalRecord) {
+	switch record.Op {
+	case journalOpUpload, journalOpDownload:
+		j.transfers[record.Filename] = record
+	case journalOpProgress:
+		if transfer, ok := j.transfers[record.Filename]; ok {
+			transfer.BlocksDone = record.BlocksDone
+			transfer.Offset = record.Offset
+		}
+	case journalOpDone:
+		delete(j.transfers, record.Filename)
+	}
+}
+
+// rewrite replaces the journal with one record per transfer in progress, and
+// reopens it for appending. The file is removed if nothing is in progress.
+func (j *TransferJournal) rewrite() error {
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+	if len(j.transfers) == 0 {
+		if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var content strings.Builder
+	for _, transfer := range j.transfers {
+		line, err := json.Marshal(transfer)
+		if err != nil {
+			return err
+		}
+		content.Write(line)
+		content.WriteString("\n")
+	}
+	if err := WriteFileAtomic(j.path, []byte(content.String()), 0644); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	return nil
+}
+
+// append persists a record before it is applied.
+func (j *TransferJournal) append(record *journalRecord) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.replay(record)
+	j.touched[record.Filename] = true
+
+	if j.f == nil {
+		f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Println("Error occured when opening the transfer journal!", err)
+			return
+		}
+		j.f = f
+	}
+	line, _ := json.Marshal(record)
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		log.Println("Error occured when writing the transfer journal!", err)
+		return
+	}
+	if err := j.f.Sync(); err != nil {
+		log.Println("Error occured when writing the transfer journal!", err)
+	}
+}
+
+// InProgress returns a description of each transfer left in progress by an
+// interrupted sync, in filename order.
+func (j *TransferJournal) InProgress() []string {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	descriptions := make([]string, 0, len(j.transfers))
+	for filename, transfer := range j.transfers {
+		descriptions = append(descriptions, fmt.Sprintf("%s of %s (version %d): %d blocks done", transfer.Op, filename, transfer.Version, transfer.BlocksDone))
+	}
+	sort.Strings(descriptions)
+	return descriptions
+}
+
+// UploadHashlist returns the hash list recorded by an interrupted upload of
+// filename, if the file still has the same stat data.
+func (j *TransferJournal) UploadHashlist(filename string, local_stat *FileStat) ([]string, string, bool) {
+	if j == nil {
+		return nil, "", false
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	transfer, ok := j.transfers[filename]
+	if !ok || transfer.Op != journalOpUpload || !local_stat.Unchanged(transfer.Stat) {
+		return nil, "", false
+	}
+	return transfer.BlockHashList, transfer.Stat.ContentHash, true
+}
+
+// StartUpload records the start of an upload, or returns the number of
+// blocks already uploaded if the same upload was interrupted.
+func (j *TransferJournal) StartUpload(fileMetaData *FileMetaData, local_stat *FileStat) (blocks_done int) {
+	if j == nil {
+		return 0
+	}
+	j.mutex.Lock()
+	transfer, ok := j.transfers[fileMetaData.Filename]
+	j.mutex.Unlock()
+	if ok && transfer.Op == journalOpUpload && transfer.Version == fileMetaData.Version && transfer.HashlistHash == hashlistHash(fileMetaData.BlockHashList) {
+		j.append(&journalRecord{Op: journalOpProgress, Filename: fileMetaData.Filename, BlocksDone: transfer.BlocksDone})
+		return transfer.BlocksDone
+	}
+
+	j.abandon(fileMetaData.Filename)
+	j.append(&journalRecord{
+		Op:            journalOpUpload,
+		Filename:      fileMetaData.Filename,
+		Version:       fileMetaData.Version,
+		HashlistHash:  hashlistHash(fileMetaData.BlockHashList),
+		BlockHashList: fileMetaData.BlockHashList,
+		Stat:          local_stat,
+	})
+	return 0
+}
+
+// ResumeDownload returns the temp file and progress of an interrupted
+// download of the same remote version of a file.
+func (j *TransferJournal) ResumeDownload(fileMetaData *FileMetaData) (temp_path string, blocks_done int, offset int64, ok bool) {
+	if j == nil {
+		return "", 0, 0, false
+	}
+	j.mutex.Lock()
+	transfer, ok := j.transfers[fileMetaData.Filename]
+	j.mutex.Unlock()
+	if !ok || transfer.Op != journalOpDownload || transfer.Version != fileMetaData.Version || transfer.HashlistHash != hashlistHash(fileMetaData.BlockHashList) {
+		j.abandon(fileMetaData.Filename)
+		return "", 0, 0, false
+	}
+	if info, err := os.Stat(transfer.TempFile); err != nil || info.Size() < transfer.Offset {
+		j.abandon(fileMetaData.Filename)
+		return "", 0, 0, false
+	}
+	j.append(&journalRecord{Op: journalOpProgress, Filename: fileMetaData.Filename, BlocksDone: transfer.BlocksDone, Offset: transfer.Offset})
+	return transfer.TempFile, transfer.BlocksDone, transfer.Offset, true
+}
+
+// StartDownload records the start of a download into temp_path.
+func (j *TransferJournal) StartDownload(fileMetaData *FileMetaData, temp_path string) {
+	if j == nil {
+		return
+	}
+	j.append(&journalRecord{
+		Op:           journalOpDownload,
+		Filename:     fileMetaData.Filename,
+		Version:      fileMetaData.Version,
+		HashlistHash: hashlistHash(fileMetaData.BlockHashList),
+		TempFile:     temp_path,
+	})
+}
+
+// Progress records that the first blocks_done blocks of a transfer are done,
+// and for downloads that they take offset bytes of the temp file.
+func (j *TransferJournal) Progress(filename string, blocks_done int, offset int64) {
+	if j == nil {
+		return
+	}
+	j.append(&journalRecord{Op: journalOpProgress, Filename: filename, BlocksDone: blocks_done, Offset: offset})
+}
+
+// Done records that a transfer is over, whether it succeeded or was abandoned.
+func (j *TransferJournal) Done(filename string) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	_, ok := j.transfers[filename]
+	j.mutex.Unlock()
+	if ok {
+		j.append(&journalRecord{Op: journalOpDone, Filename: filename})
+	}
+}
+
+// abandon ends an interrupted transfer that can't be resumed.
+func (j *TransferJournal) abandon(filename string) {
+	j.mutex.Lock()
+	transfer, ok := j.transfers[filename]
+	j.mutex.Unlock()
+	if !ok {
+		return
+	}
+	if transfer.TempFile != "" {
+		os.Remove(transfer.TempFile)
+	}
+	j.Done(filename)
+}
+
+// RemoveStaleTempFiles removes the temp files of the base directory that
+// don't belong to a transfer in progress, e.g. left by a crash during an
+// atomic write.
+func (j *TransferJournal) RemoveStaleTempFiles(baseDir string) {
+	files, err := os.ReadDir(baseDir)
+	if err != nil {
+		return
+	}
+	in_use := make(map[string]bool)
+	if j != nil {
+		j.mutex.Lock()
+		for _, transfer := range j.transfers {
+			if transfer.TempFile != "" {
+				// the recorded path is cleaned, baseDir may not be
+				in_use[filepath.Clean(transfer.TempFile)] = true
+			}
+		}
+		j.mutex.Unlock()
+	}
+	for _, file := range files {
+		path := filepath.Join(baseDir, file.Name())
+		if IsTempFile(file.Name()) && !in_use[path] {
+			os.Remove(path)
+		}
+	}
+}
+
+// AbandonUntouched drops the interrupted transfers this sync didn't resume
+// (the file changed in the meantime, on either side). It must only be called
+// once a sync visited every file, the transfers of the files a stopped sync
+// didn't reach are resumed by the next one.
+func (j *TransferJournal) AbandonUntouched() {
+	if j == nil {
+		return
+	}
+	for _, filename := range j.untouched() {
+		j.abandon(filename)
+	}
+}
+
+// Close compacts the journal to the transfers still in progress, and removes
+// it if nothing is left.
+func (j *TransferJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.rewrite()
+}
+
+func (j *TransferJournal) untouched() []string {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	filenames := make([]string, 0)
+	for filename := range j.transfers {
+		if !j.touched[filename] {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames
+}
+
+// hashlistHash identifies a hash list without storing all of it.
+func hashlistHash(hashlist []string) string {
+	return GetBlockHashString([]byte(strings.Join(hashlist, HASH_DELIMITER)))
+}
@@ -0,0 +1,204 @@
+package surfstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoveStaleTempFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseDir func(dir string) string // as given to the client, dir is the working directory
+	}{
+		{"absolute", func(dir string) string { return filepath.Join(dir, "base") }},
+		{"relative", func(dir string) string { return "base" }},
+		{"dot prefix", func(dir string) string { return "./base" }},
+		{"trailing slash", func(dir string) string { return "base/" }},
+		{"not clean", func(dir string) string { return dir + "//base/./" }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			chdir(t, dir)
+			if err := os.Mkdir("base", 0755); err != nil {
+				t.Fatal(err)
+			}
+			baseDir := test.baseDir(dir)
+
+			journal, err := OpenTransferJournal(baseDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			in_progress, err := CreateAtomicFile(ConcatPath(baseDir, "a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			in_progress.Close()
+			journal.StartDownload(&FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}}, in_progress.Name())
+			stale, err := CreateAtomicFile(ConcatPath(baseDir, "b"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stale.Close()
+
+			journal.RemoveStaleTempFiles(baseDir)
+			if _, err := os.Stat(in_progress.Name()); err != nil {
+				t.Errorf("temp file of a download in progress removed: %v", err)
+			}
+			if _, err := os.Stat(stale.Name()); !os.IsNotExist(err) {
+				t.Errorf("stale temp file kept: %v", err)
+			}
+			journal.Close()
+		})
+	}
+}
+
+func TestTransferJournalKeptUntilEveryFileIsVisited(t *testing.T) {
+	baseDir := t.TempDir()
+	a := &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{hashA}}
+	b := &FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{hashB}}
+	journal, err := OpenTransferJournal(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp_paths := make(map[string]string)
+	for _, fileMetaData := range []*FileMetaData{a, b} {
+		af, err := CreateAtomicFile(ConcatPath(baseDir, fileMetaData.Filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		af.Close()
+		temp_paths[fileMetaData.Filename] = af.Name()
+		journal.StartDownload(fileMetaData, af.Name())
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a sync stopped before reaching b resumes a only
+	journal, err = OpenTransferJournal(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok := journal.ResumeDownload(a); !ok {
+		t.Fatalf("download of a not resumed")
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	journal, err = OpenTransferJournal(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_progress := journal.InProgress(); len(in_progress) != 2 {
+		t.Errorf("in progress after a stopped sync: %v, want a and b", in_progress)
+	}
+
+	// a complete sync that didn't transfer b drops it
+	journal.ResumeDownload(a)
+	journal.AbandonUntouched()
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(temp_paths["a"]); err != nil {
+		t.Errorf("temp file of a removed: %v", err)
+	}
+	if _, err := os.Stat(temp_paths["b"]); !os.IsNotExist(err) {
+		t.Errorf("temp file of b kept: %v", err)
+	}
+	journal, err = OpenTransferJournal(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_progress := journal.InProgress(); len(in_progress) != 1 {
+		t.Errorf("in progress after a complete sync: %v, want a", in_progress)
+	}
+}
+
+// chdir changes the working directory until the end of the test.
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestSyncResumesInterruptedDownload(t *testing.T) {
+	tests := []struct {
+		name    string
+		written string // what the interrupted download wrote to the temp file
+		resumed bool
+	}{
+		{"resumed", "abcd", true},
+		{"temp file changed", "zzzz", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := startTestServer(t)
+			uploader, client := newTestClient(t, addr), newTestClient(t, addr)
+			writeTestFiles(t, uploader, map[string]string{"f": "abcdefghijkl"})
+			testSync(t, uploader)
+			var remote_FileInfoMap map[string]*FileMetaData
+			if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+				t.Fatal(err)
+			}
+
+			// a sync stopped after the first of the 3 blocks of f
+			journal, err := OpenTransferJournal(client.BaseDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			af, err := CreateAtomicFile(ConcatPath(client.BaseDir, "f"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := af.WriteString(test.written); err != nil {
+				t.Fatal(err)
+			}
+			af.Close()
+			journal.StartDownload(remote_FileInfoMap["f"], af.Name())
+			journal.Progress("f", 1, int64(len(test.written)))
+			if err := journal.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var output bytes.Buffer
+			report, err := Sync(context.Background(), SyncOptions{Client: client, Output: &output})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want_blocks := int64(3)
+			if test.resumed {
+				want_blocks = 2
+			}
+			if report.Downloaded != 1 || report.BlocksDownloaded != want_blocks {
+				t.Errorf("downloaded %d files, %d blocks, want f, %d blocks", report.Downloaded, report.BlocksDownloaded, want_blocks)
+			}
+			if resumed := strings.Contains(output.String(), "Resuming download of f"); resumed != test.resumed {
+				t.Errorf("output %q, want resumed: %v", output.String(), test.resumed)
+			}
+			if content, err := os.ReadFile(filepath.Join(client.BaseDir, "f")); err != nil || string(content) != "abcdefghijkl" {
+				t.Errorf("f is %q, %v", content, err)
+			}
+			if _, err := os.Stat(af.Name()); !os.IsNotExist(err) {
+				t.Errorf("temp file left behind: %v", err)
+			}
+			journal, err = OpenTransferJournal(client.BaseDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in_progress := journal.InProgress(); len(in_progress) != 0 {
+				t.Errorf("in progress after the sync: %v", in_progress)
+			}
+			journal.Close()
+		})
+	}
+}
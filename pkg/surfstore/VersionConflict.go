@@ -0,0 +1,60 @@
+package surfstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Version Conflict Related
+*/
+
+// ResolveVersionConflict settles an upload of local_meta_data rejected
+// because the file changed on the server since the sync got its
+// FileInfoMap, using current, the server's version sent back with the
+// rejection, instead of waiting for the next sync:
+//   - if the local file was deleted, or has the same content as current,
+//     current is applied locally
+//   - otherwise the local file is renamed with CONFLICTED_COPY_SUFFIX and
+//     uploaded under that name, and current is downloaded in its place
+//
+// It returns the files now in sync with the server, to be committed, even
+// if an error is returned.
+func ResolveVersionConflict(client RPCClient, transfers *Transfers, local_meta_data *FileMetaData, current *FileMetaData, local_FileInfoMap map[string]*FileMetaData, remote_FileInfoMap map[string]*FileMetaData) ([]*FileMetaData, error) {
+	filename := local_meta_data.Filename
+	resolved := make([]*FileMetaData, 0)
+	var copy_err error
+	same_content := !IsDeleted(current) && CompareHashlist(local_meta_data.BlockHashList, current.BlockHashList)
+	if !IsDeleted(local_meta_data) && !same_content {
+		// keep the local changes under another name
+		copy_meta_data := proto.Clone(local_meta_data).(*FileMetaData)
+		// a name free on the server and in the base directory, a file left out of the sync isn't overwritten
+		copy_meta_data.Filename = suffixedFilename(client.BaseDir, filename, CONFLICTED_COPY_SUFFIX, local_FileInfoMap, remote_FileInfoMap)
+		copy_meta_data.Version = 1
+		copy_meta_data.RenamedFrom = ""
+		copy_path := filepath.Join(client.BaseDir, copy_meta_data.Filename)
+		if err := os.Rename(filepath.Join(client.BaseDir, filename), copy_path); err != nil {
+			return nil, fmt.Errorf("keep %s as %s: %w", filename, copy_meta_data.Filename, err)
+		}
+		transfers.printf("Conflict, %s changed on the server, local changes kept in %s\n", filename, copy_meta_data.Filename)
+
+		// the blocks were uploaded before the update was rejected, a failed
+		// upload of the copy is retried by the next sync
+		var copy_stat *FileStat
+		if info, err := os.Lstat(copy_path); err == nil {
+			copy_stat = NewFileStat(info)
+		}
+		if copy_err = Upload_helper(client, transfers, copy_meta_data, copy_stat, false, NO_FILE_VERSION); copy_err == nil {
+			resolved = append(resolved, copy_meta_data)
+		}
+	}
+
+	if err := Download_helper(client, transfers, current); err != nil {
+		return resolved, err
+	}
+	transfers.Journal.Done(filename)
+	return append(resolved, current), copy_err
+}
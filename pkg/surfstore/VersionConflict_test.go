@@ -0,0 +1,87 @@
+package surfstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveVersionConflict(t *testing.T) {
+	copy_name := "a (conflicted copy).txt"
+	tests := []struct {
+		name  string
+		local string // content of the local file, "" if it was deleted
+		taken bool   // a file left out of the sync has the name of the conflicted copy
+		copy  string // name of the conflicted copy, "" if none is made
+	}{
+		{"local changes", "local", false, copy_name},
+		{"copy name taken", "local", true, "a (conflicted copy) 2.txt"},
+		{"same content", "remote", false, ""},
+		{"deleted locally", "", false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := startTestServer(t)
+			client, other := newTestClient(t, addr), newTestClient(t, addr)
+			writeTestFiles(t, client, map[string]string{"a.txt": "first"})
+			testSync(t, client)
+			testSync(t, other)
+
+			// changed on the server after the sync got the file info map
+			writeTestFiles(t, other, map[string]string{"a.txt": "remote"})
+			testSync(t, other)
+			var remote_FileInfoMap map[string]*FileMetaData
+			if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+				t.Fatal(err)
+			}
+			current := remote_FileInfoMap["a.txt"]
+
+			path := filepath.Join(client.BaseDir, "a.txt")
+			local_meta_data := NewTombstone("a.txt", 2)
+			if test.local != "" {
+				writeTestFiles(t, client, map[string]string{"a.txt": test.local})
+				hashlist, _, err := HashFile(path, client.BlockSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				local_meta_data = NewFileMetaData("a.txt", 2, hashlist, nil)
+			} else if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			if test.taken {
+				writeTestFiles(t, client, map[string]string{copy_name: "ignored"})
+			}
+			local_FileInfoMap := map[string]*FileMetaData{"a.txt": local_meta_data}
+
+			resolved, err := ResolveVersionConflict(client, NewTransfers(client, nil, nil), local_meta_data, current, local_FileInfoMap, remote_FileInfoMap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := map[string]string{"a.txt": "remote"}
+			if test.copy != "" {
+				files[test.copy] = test.local
+			}
+			if test.taken {
+				files[copy_name] = "ignored"
+			}
+			for filename, want := range files {
+				if content, err := os.ReadFile(filepath.Join(client.BaseDir, filename)); err != nil || string(content) != want {
+					t.Errorf("%s is %q, %v, want %q", filename, content, err, want)
+				}
+			}
+
+			if want := map[bool]int{true: 2, false: 1}[test.copy != ""]; len(resolved) != want || resolved[len(resolved)-1] != current {
+				t.Errorf("resolved %v, want %d files ending with the current version", resolved, want)
+			}
+			if err := client.GetFileInfoMap(&remote_FileInfoMap); err != nil {
+				t.Fatal(err)
+			}
+			if test.copy != "" && remote_FileInfoMap[test.copy].GetVersion() != 1 {
+				t.Errorf("conflicted copy not uploaded: %v", remote_FileInfoMap)
+			}
+			if test.taken && remote_FileInfoMap[copy_name] != nil {
+				t.Errorf("file left out of the sync uploaded")
+			}
+		})
+	}
+}
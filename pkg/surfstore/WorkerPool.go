@@ -0,0 +1,116 @@
+package surfstore
+
+import "sync"
+
+// WorkerPool bounds how many tasks run at the same time. A pool can be
+// shared by several concurrent Run calls, e.g. by the files transferred in
+// parallel, so the total number of block transfers in flight stays bounded.
+// A task must not call Run on the pool it is running on.
+type WorkerPool struct {
+	slots chan struct{}
+}
+
+func NewWorkerPool(size int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &WorkerPool{slots: make(chan struct{}, size)}
+}
+
+// Run runs task(i) for every i in [0, n) on the pool, waits for all of them
+// and returns the first error.
+func (p *WorkerPool) Run(n int, task func(i int) error) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	for i := 0; i < n; i++ {
+		p.slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-p.slots
+				wg.Done()
+			}()
+			if err := task(i); err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// RunOrdered runs task(i) for every i in [0, n) on the pool. done(i, err) is
+// called from the calling goroutine, in increasing order of i, as soon as
+// tasks 0 to i have all finished, so the caller can record results
+// deterministically while the tasks run in parallel.
+func (p *WorkerPool) RunOrdered(n int, task func(i int) error, done func(i int, err error)) {
+	errs := make([]error, n)
+	finished := make(chan int, n)
+	go p.Run(n, func(i int) error {
+		errs[i] = task(i)
+		finished <- i
+		return nil
+	})
+
+	completed := make([]bool, n)
+	for next := 0; next < n; {
+		completed[<-finished] = true
+		for ; next < n && completed[next]; next++ {
+			done(next, errs[next])
+		}
+	}
+}
+
+// BlockBudget bounds the blocks held in memory by the transfers of a sync,
+// however many files are transferred in parallel. A nil *BlockBudget
+// bounds nothing.
+type BlockBudget struct {
+	mutex sync.Mutex
+	freed *sync.Cond
+	size  int
+	free  int
+}
+
+func NewBlockBudget(size int) *BlockBudget {
+	if size < 1 {
+		size = 1
+	}
+	budget := &BlockBudget{size: size, free: size}
+	budget.freed = sync.NewCond(&budget.mutex)
+	return budget
+}
+
+// Acquire waits until n blocks fit in the budget, and reserves them. It
+// returns the number of blocks reserved, which is n unless n is larger
+// than the whole budget, to be released once the blocks are dropped.
+func (b *BlockBudget) Acquire(n int) int {
+	if b == nil {
+		return 0
+	}
+	if n > b.size {
+		n = b.size
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	// all n at once, two files each holding part of the budget would wait on each other
+	for b.free < n {
+		b.freed.Wait()
+	}
+	b.free -= n
+	return n
+}
+
+func (b *BlockBudget) Release(n int) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mutex.Lock()
+	b.free += n
+	b.mutex.Unlock()
+	b.freed.Broadcast()
+}
@@ -0,0 +1,108 @@
+package surfstore
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunOrdered(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		n    int
+	}{
+		{"no task", 4, 0},
+		{"one worker", 1, 20},
+		{"more workers than tasks", 16, 5},
+		{"many tasks", 4, 200},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := NewWorkerPool(test.size)
+			var running, most int32
+			done := make([]int, 0, test.n)
+			pool.RunOrdered(test.n, func(i int) error {
+				now := atomic.AddInt32(&running, 1)
+				for {
+					seen := atomic.LoadInt32(&most)
+					if now <= seen || atomic.CompareAndSwapInt32(&most, seen, now) {
+						break
+					}
+				}
+				// finish out of order
+				time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+				atomic.AddInt32(&running, -1)
+				if i%3 == 0 {
+					return errors.New("failed")
+				}
+				return nil
+			}, func(i int, err error) {
+				if (err != nil) != (i%3 == 0) {
+					t.Errorf("task %d: got error %v", i, err)
+				}
+				done = append(done, i)
+			})
+
+			if len(done) != test.n {
+				t.Fatalf("done called %d times, want %d", len(done), test.n)
+			}
+			for i := range done {
+				if done[i] != i {
+					t.Fatalf("done called in order %v", done)
+				}
+			}
+			if int(most) > test.size {
+				t.Errorf("%d tasks ran at the same time on a pool of %d", most, test.size)
+			}
+		})
+	}
+}
+
+func TestBlockBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		acquires []int
+	}{
+		{"within the budget", 8, []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"larger than the budget", 4, []int{3, 9, 4, 1}},
+		{"nothing", 4, []int{0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			budget := NewBlockBudget(test.size)
+			var held int32
+			var wg sync.WaitGroup
+			for _, n := range test.acquires {
+				wg.Add(1)
+				go func(n int) {
+					defer wg.Done()
+					reserved := budget.Acquire(n)
+					if reserved > test.size || (n <= test.size && reserved != n) {
+						t.Errorf("Acquire(%d) reserved %d", n, reserved)
+					}
+					if now := atomic.AddInt32(&held, int32(reserved)); int(now) > test.size {
+						t.Errorf("%d blocks held with a budget of %d", now, test.size)
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt32(&held, -int32(reserved))
+					budget.Release(reserved)
+				}(n)
+			}
+			wg.Wait()
+			if budget.free != test.size {
+				t.Errorf("%d blocks free once released, want %d", budget.free, test.size)
+			}
+		})
+	}
+
+	var unbounded *BlockBudget
+	if reserved := unbounded.Acquire(100); reserved != 0 {
+		t.Errorf("nil budget reserved %d", reserved)
+	}
+	unbounded.Release(0)
+}